@@ -0,0 +1,273 @@
+package mdns
+
+import (
+	"code.google.com/p/go.net/context"
+	"strings"
+	"time"
+)
+
+const (
+	// browseCheckInterval is how often a browse looks for entries that
+	// have expired without a goodbye
+	browseCheckInterval = time.Second
+
+	// browseMaxInterval caps the interval between the queries of a
+	// browse, which doubles after each query
+	browseMaxInterval = time.Minute
+)
+
+// browseInterval is the interval before the second query of a browse,
+// and may be replaced for testing
+var browseInterval = time.Second
+
+// ServiceEvent reports an instance that appeared, changed or went away
+// during a browse. Removed instances carry their last known entry.
+// Instances whose port, TXT or addresses change are reported with
+// both Added and Updated set, as they are still present.
+type ServiceEvent struct {
+	Entry   *ServiceEntry
+	Added   bool
+	Updated bool
+}
+
+// Browse is like Query, but runs until the context is done, sending an
+// event on events as each instance of the service appears and goes
+// away. See Client.Browse.
+func Browse(ctx context.Context, params *QueryParam, events chan<- *ServiceEvent) error {
+	// Create a new client
+	client, err := newClient(params.DisableIPv4, params.DisableIPv6)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Run the browse
+	return client.Browse(ctx, params, events)
+}
+
+// Browse queries for a service continuously until the context is done,
+// returning the context's error. An event is sent on events when an
+// instance is first resolved, when its records change, and when it goes
+// away, either with a goodbye or once its records expire without being
+// refreshed. The query is repeated with intervals doubling from one
+// second to a minute, refreshing the instances still present. The
+// Entries and Timeout parameters are not used.
+func (c *Client) Browse(ctx context.Context, params *QueryParam, events chan<- *ServiceEvent) error {
+	return c.browse(ctx, params, events, c.QueryContext, nil)
+}
+
+// browse is used to run a browse using the given query function, which
+// is expected to record the entries it finds in the client's cache. If
+// first is set, it is called once the events of the first query have
+// been sent.
+func (c *Client) browse(ctx context.Context, params *QueryParam, events chan<- *ServiceEvent,
+	query func(context.Context, *QueryParam) error, first func()) error {
+	entries := make(chan *ServiceEntry, 32)
+	p := *params
+	p.Entries = entries
+	p.Timeout = browseInterval
+	p.ReportAddressChanges = true
+	if err := p.validate(); err != nil {
+		return err
+	}
+	names, err := serviceNames(p.Service, p.Domain)
+	if err != nil {
+		return err
+	}
+
+	// Repeat the query until the context is done, noting when the
+	// first one returns
+	errCh := make(chan error, 1)
+	firstCh := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			if err := query(ctx, &p); err != nil {
+				errCh <- err
+				return
+			}
+			if i == 0 {
+				close(firstCh)
+			}
+			if err := ctx.Err(); err != nil {
+				errCh <- err
+				return
+			}
+			if p.Timeout *= 2; p.Timeout > browseMaxInterval {
+				p.Timeout = browseMaxInterval
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(browseCheckInterval)
+	defer ticker.Stop()
+	known := make(map[string]*ServiceEntry)
+	for {
+		firstDone := false
+		select {
+		case <-entries:
+		case <-ticker.C:
+		case <-firstCh:
+			firstCh, firstDone = nil, true
+		case err := <-errCh:
+			return err
+		}
+		if !c.browseEvents(ctx, names, known, events, p.StripTrailingDot) {
+			return ctx.Err()
+		}
+		if firstDone && first != nil {
+			first()
+		}
+	}
+}
+
+// browseEvents is used to compare the live cached entries of the
+// browsed service names with those known, sending an event for each
+// difference, with the trailing dot of the names removed if strip is
+// set. It returns false if the context is done while sending.
+func (c *Client) browseEvents(ctx context.Context, names []string,
+	known map[string]*ServiceEntry, events chan<- *ServiceEvent, strip bool) bool {
+	live := make(map[string]*ServiceEntry)
+	for _, e := range c.Entries() {
+		if !e.Expired && browsed(e.Name, names) {
+			live[e.Name] = e
+		}
+	}
+
+	var pending []*ServiceEvent
+	for name, e := range live {
+		if old, ok := known[name]; !ok {
+			pending = append(pending, &ServiceEvent{Entry: e, Added: true})
+		} else if entryChanged(old, e) {
+			pending = append(pending, &ServiceEvent{Entry: e, Added: true, Updated: true})
+		}
+	}
+	for name, e := range known {
+		if _, ok := live[name]; !ok {
+			pending = append(pending, &ServiceEvent{Entry: e})
+		}
+	}
+	for _, ev := range pending {
+		out := ev
+		if strip {
+			e := *ev.Entry
+			e.Name = strings.TrimSuffix(e.Name, ".")
+			out = &ServiceEvent{Entry: &e, Added: ev.Added, Updated: ev.Updated}
+		}
+		select {
+		case events <- out:
+		case <-ctx.Done():
+			return false
+		}
+		if ev.Added {
+			known[ev.Entry.Name] = ev.Entry
+		} else {
+			delete(known, ev.Entry.Name)
+		}
+	}
+	return true
+}
+
+// entryChanged is used to check if a revision of an entry differs from
+// an earlier one in what it describes, rather than just being refreshed
+func entryChanged(old, e *ServiceEntry) bool {
+	return old.Port != e.Port || old.Info != e.Info ||
+		!old.AddrV4.Equal(e.AddrV4) || !old.AddrV6.Equal(e.AddrV6)
+}
+
+// browsed is used to check if an instance name belongs to one of the
+// browsed service names
+func browsed(name string, names []string) bool {
+	key := nameKey(name)
+	for _, service := range names {
+		if strings.HasSuffix(key, "."+nameKey(service)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch browses for a service in the local domain until the context is
+// done, for callers that render the current instances and then apply
+// changes. It returns the instances found by the first query of the
+// browse, then sends an event on the returned channel as instances
+// appear, change and go away, as described for Client.Browse. The
+// channel is closed once the context is done.
+func Watch(ctx context.Context, service string) ([]*ServiceEntry, <-chan *ServiceEvent, error) {
+	// Create a new client, closed when the browse ends
+	client, err := NewClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	return watch(ctx, DefaultParams(service),
+		func(ctx context.Context, params *QueryParam, events chan<- *ServiceEvent, first func()) error {
+			defer client.Close()
+			return client.browse(ctx, params, events, client.QueryContext, first)
+		})
+}
+
+// watch is used to split the events of a browse run with the given
+// browse function into a snapshot of the instances found during its
+// first query, and a channel of the events after that. The browse
+// function calls first once the events of its first query are sent.
+func watch(ctx context.Context, params *QueryParam,
+	browse func(context.Context, *QueryParam, chan<- *ServiceEvent, func()) error) ([]*ServiceEntry, <-chan *ServiceEvent, error) {
+	in := make(chan *ServiceEvent, 32)
+	errCh := make(chan error, 1)
+	firstCh := make(chan struct{})
+	go func() {
+		errCh <- browse(ctx, params, in, func() { close(firstCh) })
+		close(in)
+	}()
+
+	// Fold the events of the first query into the snapshot, including
+	// any still buffered once it is done
+	known := make(map[string]*ServiceEntry)
+	fold := func(ev *ServiceEvent) {
+		if ev.Added {
+			known[ev.Entry.Name] = ev.Entry
+		} else {
+			delete(known, ev.Entry.Name)
+		}
+	}
+	for collecting := true; collecting; {
+		select {
+		case ev, ok := <-in:
+			if !ok {
+				return nil, nil, <-errCh
+			}
+			fold(ev)
+		case <-firstCh:
+			for draining := true; draining; {
+				select {
+				case ev, ok := <-in:
+					if !ok {
+						draining = false
+						break
+					}
+					fold(ev)
+				default:
+					draining = false
+				}
+			}
+			collecting = false
+		}
+	}
+	snapshot := make([]*ServiceEntry, 0, len(known))
+	for _, e := range known {
+		snapshot = append(snapshot, e)
+	}
+	SortEntries(snapshot)
+
+	// Forward the later events until the browse ends
+	out := make(chan *ServiceEvent, 32)
+	go func() {
+		defer close(out)
+		for ev := range in {
+			select {
+			case out <- ev:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return snapshot, out, nil
+}
@@ -0,0 +1,199 @@
+package mdns
+
+import (
+	"code.google.com/p/go.net/context"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_Browse(t *testing.T) {
+	old := browseInterval
+	defer func() { browseInterval = old }()
+	browseInterval = 10 * time.Millisecond
+
+	// The instance is announced, then says goodbye, while an instance
+	// of another service is ignored
+	c := &Client{cache: newEntryCache()}
+	queries := 0
+	query := func(ctx context.Context, params *QueryParam) error {
+		if params.Service != "_http._tcp" {
+			t.Fatalf("bad: %v", params)
+		}
+		now := time.Now()
+		e := &ServiceEntry{Name: "one._http._tcp.local.", ExpiresAt: now.Add(time.Minute)}
+		switch queries {
+		case 0:
+			other := &ServiceEntry{Name: "two._ftp._tcp.local.", ExpiresAt: now.Add(time.Minute)}
+			c.cache.update(other)
+			c.cache.update(e)
+			params.Entries <- e
+		case 1:
+			e.ExpiresAt = now
+			c.cache.update(e)
+			params.Entries <- e
+		}
+		queries++
+
+		select {
+		case <-time.After(params.Timeout):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan *ServiceEvent, 4)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.browse(ctx, &QueryParam{Service: "_http._tcp"}, events, query, nil)
+	}()
+
+	for _, added := range []bool{true, false} {
+		select {
+		case ev := <-events:
+			if ev.Added != added || ev.Entry.Name != "one._http._tcp.local." {
+				t.Fatalf("bad: %v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("browse not stopped")
+	}
+	if len(events) != 0 {
+		t.Fatalf("bad: %d", len(events))
+	}
+}
+
+func TestClient_BrowseEvents_StripTrailingDot(t *testing.T) {
+	c := &Client{cache: newEntryCache()}
+	c.cache.update(&ServiceEntry{Name: "one._http._tcp.local.", ExpiresAt: time.Now().Add(time.Minute)})
+
+	known := make(map[string]*ServiceEntry)
+	events := make(chan *ServiceEvent, 4)
+	if !c.browseEvents(context.Background(), []string{"_http._tcp.local."}, known, events, true) {
+		t.Fatalf("stopped")
+	}
+	if ev := <-events; !ev.Added || ev.Entry.Name != "one._http._tcp.local" {
+		t.Fatalf("bad: %v", ev.Entry)
+	}
+
+	// The instance is still known by its name as received
+	if _, ok := known["one._http._tcp.local."]; !ok {
+		t.Fatalf("bad: %v", known)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	old := browseInterval
+	defer func() { browseInterval = old }()
+	browseInterval = 10 * time.Millisecond
+
+	// The instance is running, then moves port, then says goodbye, as
+	// the stage is advanced
+	s := makeService(t)
+	ptr := dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR}
+	running := s.Records(ptr)
+	s.Port = 8080
+	moved := s.Records(ptr)
+	goodbye := &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   "_http._tcp.local.",
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    0,
+		},
+		Ptr: s.instanceAddr,
+	}
+
+	c := &Client{cache: newEntryCache()}
+	var state *queryState
+	var stage int32
+	query := func(ctx context.Context, params *QueryParam) error {
+		if state == nil {
+			state = newQueryState(params, discardQuery)
+			state.observe = c.cache.update
+		}
+		switch atomic.LoadInt32(&stage) {
+		case 0:
+			state.handleResponse(&dns.Msg{Answer: running}, nil)
+		case 1:
+			state.handleResponse(&dns.Msg{Answer: moved}, nil)
+		case 2:
+			state.handleResponse(&dns.Msg{Answer: []dns.RR{goodbye}}, nil)
+		}
+
+		select {
+		case <-time.After(params.Timeout):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	browse := func(ctx context.Context, params *QueryParam, events chan<- *ServiceEvent, first func()) error {
+		return c.browse(ctx, params, events, query, first)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snapshot, events, err := watch(ctx, &QueryParam{Service: "_http._tcp"}, browse)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(snapshot) != 1 || snapshot[0].Name != s.instanceAddr {
+		t.Fatalf("bad: %v", snapshot)
+	}
+
+	// A port change is only noticed by the periodic check of the cache
+	next := func() *ServiceEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(2 * browseCheckInterval):
+			t.Fatalf("timeout")
+		}
+		return nil
+	}
+	atomic.StoreInt32(&stage, 1)
+	if ev := next(); !ev.Added || !ev.Updated || ev.Entry.Port != 8080 {
+		t.Fatalf("bad: %v", ev)
+	}
+	atomic.StoreInt32(&stage, 2)
+	if ev := next(); ev.Added || ev.Updated || ev.Entry.Name != s.instanceAddr {
+		t.Fatalf("bad: %v", ev)
+	}
+
+	// The channel is closed once the context is done
+	cancel()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("events not closed")
+		}
+	}
+}
+
+func TestWatch_Error(t *testing.T) {
+	c := &Client{cache: newEntryCache()}
+	browse := func(ctx context.Context, params *QueryParam, events chan<- *ServiceEvent, first func()) error {
+		return c.browse(ctx, params, events, c.QueryContext, first)
+	}
+	if _, _, err := watch(context.Background(), &QueryParam{}, browse); err == nil {
+		t.Fatalf("expected error")
+	}
+}
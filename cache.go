@@ -0,0 +1,94 @@
+package mdns
+
+import (
+	"sync"
+	"time"
+)
+
+// entryCache is used to retain resolved entries across queries, keyed
+// by instance name. Entries are flagged as expired once their TTL
+// passes, and removed once they have been expired for a while.
+type entryCache struct {
+	entries map[string]*ServiceEntry
+	lock    sync.Mutex
+}
+
+// newEntryCache is used to create an empty cache
+func newEntryCache() *entryCache {
+	return &entryCache{
+		entries: make(map[string]*ServiceEntry),
+	}
+}
+
+// update is used to store a copy of an entry, replacing any previous
+// version of the instance. The UserData of the previous version is
+// carried over to the entry.
+func (c *entryCache) update(e *ServiceEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if old, ok := c.entries[e.Name]; ok && e.UserData == nil {
+		e.UserData = old.UserData
+	}
+	dup := *e
+	dup.Expired = false
+	dup.ExpiredAt = time.Time{}
+	c.entries[e.Name] = &dup
+}
+
+// clear is used to remove all the entries
+func (c *entryCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]*ServiceEntry)
+}
+
+// setUserData is used to set the UserData of a cached instance
+func (c *entryCache) setUserData(name string, data interface{}) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[name]
+	if !ok {
+		return false
+	}
+	e.UserData = data
+	return true
+}
+
+// evictSeenBefore is used to remove the entries last seen before the
+// cutoff. Entries never seen are kept.
+func (c *entryCache) evictSeenBefore(cutoff time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for name, e := range c.entries {
+		if !e.LastSeen.IsZero() && e.LastSeen.Before(cutoff) {
+			delete(c.entries, name)
+		}
+	}
+}
+
+// snapshot is used to expire entries as of now, remove any that have
+// been expired for longer than retention, and return copies of the
+// rest sorted by name
+func (c *entryCache) snapshot(now time.Time, retention time.Duration) []*ServiceEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var out []*ServiceEntry
+	for name, e := range c.entries {
+		if !e.Expired && !now.Before(e.ExpiresAt) {
+			e.Expired = true
+			e.ExpiredAt = e.ExpiresAt
+		}
+		if e.Expired && now.Sub(e.ExpiredAt) > retention {
+			delete(c.entries, name)
+			continue
+		}
+		dup := *e
+		out = append(out, &dup)
+	}
+	SortEntries(out)
+	return out
+}
@@ -0,0 +1,63 @@
+package mdns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEntryCache_ExpiredRetention(t *testing.T) {
+	c := newEntryCache()
+	start := time.Now()
+	c.update(&ServiceEntry{
+		Name:      "hostname._http._tcp.local.",
+		ExpiresAt: start.Add(time.Second),
+	})
+
+	// Live until the TTL passes
+	out := c.snapshot(start, 5*time.Second)
+	if len(out) != 1 || out[0].Expired {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Retained while within the window
+	out = c.snapshot(start.Add(3*time.Second), 5*time.Second)
+	if len(out) != 1 || !out[0].Expired {
+		t.Fatalf("bad: %v", out)
+	}
+	if !out[0].ExpiredAt.Equal(start.Add(time.Second)) {
+		t.Fatalf("bad: %v", out[0].ExpiredAt)
+	}
+	out = c.snapshot(start.Add(6*time.Second), 5*time.Second)
+	if len(out) != 1 || !out[0].Expired {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Then removed
+	out = c.snapshot(start.Add(7*time.Second), 5*time.Second)
+	if len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+	if len(c.entries) != 0 {
+		t.Fatalf("bad: %v", c.entries)
+	}
+}
+
+func TestEntryCache_Refresh(t *testing.T) {
+	c := newEntryCache()
+	start := time.Now()
+	e := &ServiceEntry{
+		Name:      "hostname._http._tcp.local.",
+		ExpiresAt: start.Add(time.Second),
+	}
+	c.update(e)
+	if out := c.snapshot(start.Add(2*time.Second), time.Minute); !out[0].Expired {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Seeing the instance again revives it
+	e.ExpiresAt = start.Add(time.Minute)
+	c.update(e)
+	if out := c.snapshot(start.Add(2*time.Second), time.Minute); out[0].Expired {
+		t.Fatalf("bad: %v", out)
+	}
+}
@@ -1,284 +1,2659 @@
 package mdns
 
 import (
+	"bytes"
+	"code.google.com/p/go.net/context"
 	"code.google.com/p/go.net/ipv4"
 	"code.google.com/p/go.net/ipv6"
 	"fmt"
 	"github.com/miekg/dns"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 // ServiceEntry is returned after we query for a service
 type ServiceEntry struct {
-	Name string
+	Name   string
+	FQDN   string // Name as received, with the trailing dot
+	AddrV4 net.IP
+	AddrV6 net.IP
+	Port   int
+	Info   string // TXT strings joined by "|", or QueryParam.InfoSeparator
+
+	// AddrZone is the zone of AddrV6 if it is link-local, naming the
+	// interface the response was received on, without which the address
+	// cannot be connected to
+	AddrZone string
+
+	// InfoFields holds the strings of the TXT record as received
+	InfoFields []string
+
+	// InvalidTXT is set if a string of the TXT record is not valid
+	// UTF-8. The raw bytes are kept in InfoFields.
+	InvalidTXT bool
+
+	// Addr is the first address seen, of either family.
+	//
+	// Deprecated: use AddrV4 or AddrV6.
 	Addr net.IP
-	Port int
-	Info string
 
-	hasTXT bool
-	sent   bool
-}
+	// Priority and Weight are taken from the SRV record
+	Priority uint16
+	Weight   uint16
+
+	// Incomplete is set on the partially resolved entries returned
+	// by Client.InProgress
+	Incomplete bool
+
+	// Subtypes lists the service subtypes the instance was seen
+	// advertising, e.g. "_printer" for "_printer._sub._http._tcp.local."
+	Subtypes []string
+
+	// ExpiresAt is when the entry expires, based on the smallest TTL of
+	// its records. Entries retained by a Client are marked Expired once
+	// this passes, and are kept for a while with ExpiredAt set.
+	ExpiresAt time.Time
+	Expired   bool
+	ExpiredAt time.Time
+
+	// TTL is the smallest TTL, in seconds, of the SRV, TXT, A and AAAA
+	// records the entry was resolved from, which is how long a cache
+	// may consider it valid
+	TTL uint32
+
+	// LastSeen is when a record for the instance was last received,
+	// including refreshes of records already known
+	LastSeen time.Time
+
+	// Signed is set when the DNSSEC query option is used and every
+	// response the entry was resolved from carried valid signatures
+	Signed bool
+
+	// ChangedKeys lists the TXT keys added, removed or changed when an
+	// entry is emitted again because its TXT record was updated
+	ChangedKeys []string
+
+	// AddressChanged is set when an entry is emitted again because its
+	// IPv4 or IPv6 address changed, such as on a DHCP renewal, with
+	// PreviousAddr holding the address it replaced. This is only done
+	// if the ReportAddressChanges parameter is set.
+	AddressChanged bool
+	PreviousAddr   net.IP
+
+	// Protocol is the protocol label of the instance's service, either
+	// "_tcp" or "_udp", useful when browsing both protocols
+	Protocol string
+
+	// UserData is available to callers to attach their own state to an
+	// instance. It is never interpreted, and a Client carries it over to
+	// later revisions of the instance once set with SetUserData.
+	UserData interface{}
+
+	hasTXT     bool
+	sent       bool
+	txtUpdated bool
+	target     string // SRV target, asked for its addresses if needed
+
+	// emittedV4 and emittedV6 are the addresses last emitted, and
+	// emittedGoodbye whether it was last emitted as gone
+	emittedV4      net.IP
+	emittedV6      net.IP
+	emittedGoodbye bool
+
+	hasTTL  bool // Set once a TTL is observed
+	goodbye bool // Set once a goodbye PTR is seen
+}
+
+// DialAddr returns the address of the instance in the form used by
+// net.Dial, such as "192.168.1.2:80" or "[fe80::1%eth0]:80". The IPv4
+// address is used if the instance has one. It returns an empty string
+// if no address is known.
+func (s *ServiceEntry) DialAddr() string {
+	var host string
+	switch {
+	case s.AddrV4 != nil:
+		host = s.AddrV4.String()
+	case s.AddrV6 != nil:
+		host = s.AddrV6.String()
+		if s.AddrZone != "" {
+			host += "%" + s.AddrZone
+		}
+	case s.Addr != nil:
+		host = s.Addr.String()
+	default:
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(s.Port))
+}
+
+// TXTMap returns the TXT strings of the entry as a map, splitting each
+// on the first "=". Strings without one map to an empty value. Only the
+// first occurrence of a key is kept.
+func (s *ServiceEntry) TXTMap() map[string]string {
+	m := make(map[string]string, len(s.InfoFields))
+	for _, field := range s.InfoFields {
+		key, value := field, ""
+		if idx := strings.Index(field, "="); idx >= 0 {
+			key, value = field[:idx], field[idx+1:]
+		}
+		if _, ok := m[key]; key != "" && !ok {
+			m[key] = value
+		}
+	}
+	return m
+}
+
+// complete is used to check if we have all the info we need
+func (s *ServiceEntry) complete() bool {
+	return (s.AddrV4 != nil || s.AddrV6 != nil) && s.Port != 0 && s.hasTXT
+}
+
+// ToRecords is used to convert the entry into the PTR, SRV, TXT and
+// A or AAAA records that describe it, using the given TTL. This allows
+// a discovered service to be republished.
+func (s *ServiceEntry) ToRecords(ttl uint32) []dns.RR {
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{
+			Name:   name,
+			Rrtype: rrtype,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		}
+	}
+
+	// Point the service, and any subtypes, at the instance
+	service := serviceName(s.Name)
+	recs := []dns.RR{&dns.PTR{Hdr: hdr(service, dns.TypePTR), Ptr: s.Name}}
+	for _, sub := range s.Subtypes {
+		recs = append(recs, &dns.PTR{
+			Hdr: hdr(fmt.Sprintf("%s._sub.%s", sub, service), dns.TypePTR),
+			Ptr: s.Name,
+		})
+	}
+
+	recs = append(recs, &dns.SRV{
+		Hdr:      hdr(s.Name, dns.TypeSRV),
+		Priority: s.Priority,
+		Weight:   s.Weight,
+		Port:     uint16(s.Port),
+		Target:   s.Name,
+	})
+	txt := s.InfoFields
+	if txt == nil {
+		txt = []string{s.Info}
+	}
+	recs = append(recs, &dns.TXT{
+		Hdr: hdr(s.Name, dns.TypeTXT),
+		Txt: txt,
+	})
+
+	// Entries built with only the deprecated Addr are still supported
+	v4, v6 := s.AddrV4, s.AddrV6
+	if v4 == nil && v6 == nil {
+		if ipv4 := s.Addr.To4(); ipv4 != nil {
+			v4 = ipv4
+		} else {
+			v6 = s.Addr
+		}
+	}
+	if v4 != nil {
+		recs = append(recs, &dns.A{Hdr: hdr(s.Name, dns.TypeA), A: v4.To4()})
+	}
+	if v6 != nil {
+		recs = append(recs, &dns.AAAA{Hdr: hdr(s.Name, dns.TypeAAAA), AAAA: v6})
+	}
+	return recs
+}
+
+// FromRecords is used to build a ServiceEntry from a set of records,
+// such as those produced by ToRecords. If the records describe several
+// instances, the first one referenced is returned. Nil is returned if
+// no instance is described.
+func FromRecords(recs []dns.RR) *ServiceEntry {
+	var first *ServiceEntry
+	inprogress := make(map[string]*ServiceEntry)
+	for _, rec := range recs {
+		if inp := mergeRecord(inprogress, rec, 0); inp != nil && first == nil {
+			first = inp
+		}
+	}
+	return first
+}
+
+// serviceName is used to strip the instance label from an instance name
+func serviceName(instance string) string {
+	for i := 0; i < len(instance); i++ {
+		switch instance[i] {
+		case '\\':
+			i++
+		case '.':
+			return instance[i+1:]
+		}
+	}
+	return ""
+}
+
+// protocolName is used to get the protocol label of the service of an
+// instance, or an empty string if it has none
+func protocolName(instance string) string {
+	labels := strings.SplitN(serviceName(instance), ".", 3)
+	if len(labels) < 2 {
+		return ""
+	}
+	switch proto := labels[1]; proto {
+	case "_tcp", "_udp":
+		return proto
+	}
+	return ""
+}
+
+// serviceNames is used to get the names to query for a service. A
+// service given without a protocol, such as "_http", is browsed over
+// both "_tcp" and "_udp".
+func serviceNames(service, domain string) ([]string, error) {
+	service, domain = trimDot(service), trimDot(domain)
+	if strings.Contains(service, ".") {
+		return []string{fmt.Sprintf("%s.%s.", service, domain)}, nil
+	}
+	if !validServiceLabel(service) {
+		return nil, fmt.Errorf("Invalid service name %q", service)
+	}
+	return []string{
+		fmt.Sprintf("%s._tcp.%s.", service, domain),
+		fmt.Sprintf("%s._udp.%s.", service, domain),
+	}, nil
+}
+
+// validServiceLabel is used to check a service label as described by
+// RFC 6763: an underscore followed by up to 15 letters, digits and
+// hyphens, including at least one letter, without leading, trailing or
+// adjacent hyphens
+func validServiceLabel(label string) bool {
+	if len(label) < 2 || len(label) > 16 || label[0] != '_' {
+		return false
+	}
+	name := label[1:]
+	if name[0] == '-' || name[len(name)-1] == '-' || strings.Contains(name, "--") {
+		return false
+	}
+	letter := false
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			letter = true
+		case c >= '0' && c <= '9', c == '-':
+		default:
+			return false
+		}
+	}
+	return letter
+}
+
+// addrChange is used to find the address of either family that has
+// changed since the entry was last emitted, returning nil if none has
+func (s *ServiceEntry) addrChange() net.IP {
+	if s.emittedV4 != nil && !s.emittedV4.Equal(s.AddrV4) {
+		return s.emittedV4
+	}
+	if s.emittedV6 != nil && !s.emittedV6.Equal(s.AddrV6) {
+		return s.emittedV6
+	}
+	return nil
+}
+
+// keepEmitted is used to hold on to the emitted addresses while a
+// response still lists them, so that a host with several addresses
+// is not flagged as changed when it orders its records differently.
+// It reports whether the IPv6 address was put back.
+func (s *ServiceEntry) keepEmitted(addrs []net.IP) bool {
+	keptV6 := false
+	for _, ip := range addrs {
+		if s.emittedV4 != nil && s.emittedV4.Equal(ip) {
+			s.AddrV4 = s.emittedV4
+		}
+		if s.emittedV6 != nil && s.emittedV6.Equal(ip) && !s.AddrV6.Equal(ip) {
+			s.AddrV6 = s.emittedV6
+			keptV6 = true
+		}
+	}
+	return keptV6
+}
+
+// markEmitted is used to record the addresses and goodbye state of an
+// emitted entry, and to clear the change flags it was emitted with
+func (s *ServiceEntry) markEmitted() {
+	s.emittedV4 = s.AddrV4
+	s.emittedV6 = s.AddrV6
+	s.emittedGoodbye = s.goodbye
+	s.AddressChanged = false
+	s.PreviousAddr = nil
+}
+
+// observeTTL is used to track the smallest record TTL
+func (s *ServiceEntry) observeTTL(ttl uint32) {
+	if !s.hasTTL || ttl < s.TTL {
+		s.TTL = ttl
+		s.hasTTL = true
+	}
+}
+
+// refreshExpiry is used to compute when the entry expires
+func (s *ServiceEntry) refreshExpiry(now time.Time) {
+	if s.goodbye {
+		s.ExpiresAt = now
+		return
+	}
+	s.ExpiresAt = now.Add(time.Duration(s.TTL) * time.Second)
+}
+
+// addSubtype is used to record a subtype, ignoring duplicates
+func (s *ServiceEntry) addSubtype(sub string) {
+	for _, existing := range s.Subtypes {
+		if existing == sub {
+			return
+		}
+	}
+	s.Subtypes = append(s.Subtypes, sub)
+}
+
+// SortEntries sorts entries in place by Name, then Addr, then Port, so
+// that results can be presented in a stable order. Entries without an
+// address sort before those with one.
+func SortEntries(entries []*ServiceEntry) {
+	sort.Sort(entrySorter(entries))
+}
+
+// entrySorter implements sort.Interface for SortEntries
+type entrySorter []*ServiceEntry
+
+func (e entrySorter) Len() int      { return len(e) }
+func (e entrySorter) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e entrySorter) Less(i, j int) bool {
+	a, b := e[i], e[j]
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	if cmp := bytes.Compare(a.Addr.To16(), b.Addr.To16()); cmp != 0 {
+		return cmp < 0
+	}
+	return a.Port < b.Port
+}
+
+// MergeEntries combines several sets of entries, such as the results of
+// repeated browses or of browses on different interfaces, into one set
+// sorted as by SortEntries. Entries for the same instance are merged,
+// with the values of the most recently seen entry taking precedence,
+// including its port. The addresses are combined, keeping the latest of
+// each family, whether from AddrV4 and AddrV6 or the deprecated Addr,
+// and so are the subtypes.
+func MergeEntries(sets ...[]*ServiceEntry) []*ServiceEntry {
+	var all []*ServiceEntry
+	for _, set := range sets {
+		all = append(all, set...)
+	}
+
+	// Apply the oldest entries first so that fresher values win
+	sort.Stable(lastSeenSorter(all))
+	merged := make(map[string]*ServiceEntry)
+	var out []*ServiceEntry
+	for _, e := range all {
+		m, ok := merged[e.Name]
+		v4, v6 := familyAddrs(e)
+		if !ok {
+			dup := *e
+			dup.AddrV4, dup.AddrV6 = v4, v6
+			dup.Subtypes = append([]string(nil), e.Subtypes...)
+			merged[e.Name] = &dup
+			out = append(out, &dup)
+			continue
+		}
+		if e.Addr != nil {
+			m.Addr = e.Addr
+		}
+		if v4 != nil {
+			m.AddrV4 = v4
+		}
+		if v6 != nil {
+			m.AddrV6 = v6
+		}
+		if e.Port != 0 {
+			m.Port = e.Port
+			m.Priority = e.Priority
+			m.Weight = e.Weight
+		}
+		if e.Info != "" || e.InfoFields != nil {
+			m.Info = e.Info
+			m.InfoFields = e.InfoFields
+		}
+		for _, sub := range e.Subtypes {
+			m.addSubtype(sub)
+		}
+		if e.ExpiresAt.After(m.ExpiresAt) {
+			m.ExpiresAt = e.ExpiresAt
+			m.Expired = e.Expired
+			m.ExpiredAt = e.ExpiredAt
+		}
+		m.Incomplete = m.Incomplete && e.Incomplete
+		m.Signed = m.Signed && e.Signed
+		m.LastSeen = e.LastSeen
+	}
+	SortEntries(out)
+	return out
+}
+
+// familyAddrs is used to get the IPv4 and IPv6 addresses of an entry,
+// falling back to Addr for entries that only set it
+func familyAddrs(e *ServiceEntry) (v4, v6 net.IP) {
+	v4, v6 = e.AddrV4, e.AddrV6
+	if e.Addr == nil {
+		return
+	}
+	if e.Addr.To4() != nil {
+		if v4 == nil {
+			v4 = e.Addr
+		}
+	} else if v6 == nil {
+		v6 = e.Addr
+	}
+	return
+}
+
+// lastSeenSorter implements sort.Interface ordering entries by LastSeen
+type lastSeenSorter []*ServiceEntry
+
+func (e lastSeenSorter) Len() int           { return len(e) }
+func (e lastSeenSorter) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e lastSeenSorter) Less(i, j int) bool { return e[i].LastSeen.Before(e[j].LastSeen) }
+
+// FamilyStrategy selects the address families queries are sent over
+type FamilyStrategy int
+
+const (
+	// BothParallel sends queries over IPv4 and IPv6 at once
+	BothParallel FamilyStrategy = iota
+
+	// V6ThenV4 sends queries over IPv6, falling back to IPv4 if there
+	// is no response within the grace period
+	V6ThenV4
+
+	// V4ThenV6 sends queries over IPv4, falling back to IPv6 if there
+	// is no response within the grace period
+	V4ThenV6
+)
+
+// defaultDeliveryTimeout is how long a blocking delivery waits for the
+// reader of the entries before dropping an entry
+const defaultDeliveryTimeout = 100 * time.Millisecond
+
+// defaultFollowUpWindow is how long repeated follow up queries for an
+// instance are suppressed
+const defaultFollowUpWindow = time.Second
+
+// AddressFamily selects entries by the family of their addresses
+type AddressFamily int
+
+const (
+	// AnyFamily accepts entries with an address of either family
+	AnyFamily AddressFamily = iota
+
+	// IPv4Family accepts entries with an IPv4 address
+	IPv4Family
+
+	// IPv6Family accepts entries with an IPv6 address
+	IPv6Family
+)
+
+// defaultFamilyGrace is how long to wait for a response over the
+// preferred address family before falling back to the other
+const defaultFamilyGrace = 250 * time.Millisecond
+
+// QueryParam is used to customize how a Lookup is performed
+type QueryParam struct {
+	Service   string               // Service to lookup, both protocols if none
+	Domain    string               // Lookup domain, default "local"
+	Timeout   time.Duration        // Lookup timeout, default 1 second
+	Interface *net.Interface       // Multicast interface to use
+	Entries   chan<- *ServiceEntry // Entries Channel
+
+	// MaxTrackedInstances limits the number of distinct names tracked
+	// while a query is in progress. Once reached, records for new names
+	// are dropped. This bounds memory use on hostile networks. If zero,
+	// there is no limit.
+	MaxTrackedInstances int
+
+	// ReQueryOnFirstResponse reissues the service query once when the
+	// first response arrives, giving responders that missed the initial
+	// query another chance to answer.
+	ReQueryOnFirstResponse bool
+
+	// Retries is the number of times the initial query is retransmitted
+	// while waiting for responses, with the interval between them
+	// doubling from 100ms. Retransmits stop once the timeout passes or
+	// the context is done. DefaultParams sets it to 3.
+	Retries int
+
+	// RestrictSource if provided causes responses from any other
+	// source address to be ignored
+	RestrictSource net.IP
+
+	// DedupKey if provided is used to decide if two complete entries are
+	// equivalent, in which case only the first is emitted. By default
+	// entries are keyed by instance name.
+	DedupKey func(*ServiceEntry) string
+
+	// ReportAddressChanges causes an entry that was already emitted to
+	// be emitted again, with AddressChanged set, when its IPv4 or IPv6
+	// address changes. Otherwise only the first entry for an instance
+	// is emitted under the default DedupKey. Browse sets it.
+	ReportAddressChanges bool
+
+	// ReadyCheck if provided is polled before the first query is sent,
+	// which is held until it returns true or ReadyTimeout elapses. This
+	// avoids wasting the query while the network is still coming up,
+	// for example by checking that the interface has an address.
+	ReadyCheck   func() bool
+	ReadyTimeout time.Duration // Defaults to 5 seconds
+
+	// DrainOnTimeout causes responses that were already received when
+	// the timeout fires to be processed before returning, rather than
+	// discarded. The drain is bounded to a short window.
+	DrainOnTimeout bool
+
+	// Opcode, Authoritative and RecursionDesired set the header of the
+	// query messages. The default is a standard query without recursion
+	// desired, as is appropriate for mDNS. Recursion may only be asked
+	// for with a standard query.
+	Opcode           int
+	Authoritative    bool
+	RecursionDesired bool
+
+	// UnicastFollowUp causes the per-instance follow up queries to be
+	// sent unicast to the responder that mentioned the instance, rather
+	// than multicast, reducing multicast traffic
+	UnicastFollowUp bool
+
+	// WantUnicastResponse sets the QU bit on the questions asked, as
+	// described in RFC 6762, asking responders to reply unicast to the
+	// client's socket rather than multicast, reducing multicast traffic
+	WantUnicastResponse bool
+
+	// Metrics if provided records the activity of the query
+	Metrics MetricsRecorder
+
+	// DisableCompression sends queries without name compression,
+	// for interoperability with parsers that mishandle it
+	DisableCompression bool
+
+	// OnFirstResponse if provided is called once when the first response
+	// is received, before any entry is emitted
+	OnFirstResponse func()
+
+	// RotateQueries varies the EDNS padding of successive queries, so
+	// that snooping caches that suppress identical queries let them pass
+	RotateQueries bool
+
+	// DNSSEC sets the DO bit on queries, asking responders to include
+	// their RRSIG records. Entries resolved only from responses carrying
+	// signatures are flagged as Signed. Validate if provided is used to
+	// verify the signatures of each such response.
+	DNSSEC   bool
+	Validate func(resp *dns.Msg) bool
+
+	// FamilyStrategy selects the address families queries are sent
+	// over, and FamilyGrace how long to wait for a response over the
+	// preferred family before falling back. The default is to use both
+	// families in parallel, and a grace period of 250ms.
+	FamilyStrategy FamilyStrategy
+	FamilyGrace    time.Duration
+
+	// Errors if provided receives the errors sending follow up queries,
+	// which otherwise do not stop the query. Sends will not block.
+	Errors chan<- error
+
+	// BlockUntilSent makes the delivery of each entry wait up to
+	// DeliveryTimeout for the reader, rather than dropping the entry if
+	// Entries is not ready, so a slow reader slows the query down instead
+	// of losing entries. The query timeout still applies: a send blocked
+	// when it fires is abandoned, dropping the entry, and the query then
+	// returns without processing any further responses. DeliveryTimeout
+	// defaults to 100ms.
+	BlockUntilSent  bool
+	DeliveryTimeout time.Duration
+
+	// FollowUpWindow is how long after a follow up query for an instance
+	// another is suppressed, when further responses mention the instance
+	// before it is resolved. Defaults to one second.
+	FollowUpWindow time.Duration
+
+	// DisableIPv4 and DisableIPv6 prevent the query from using the given
+	// address family. The clients created by the package level query
+	// functions do not bind sockets for a disabled family at all.
+	DisableIPv4 bool
+	DisableIPv6 bool
+
+	// QueryType is the type of the service question, such as dns.TypePTR
+	// for responders that ignore ANY questions. When set to a type other
+	// than ANY, instances are resolved by asking for their SRV and TXT
+	// records rather than with ANY questions. Defaults to ANY.
+	QueryType uint16
+
+	// StripTrailingDot removes the trailing dot from the names of the
+	// entries sent on Entries, and of those in Browse events, for
+	// display. FQDN keeps the name as received. The entries a Client
+	// keeps across queries, returned by Entries and InProgress, always
+	// have the name as received.
+	StripTrailingDot bool
+
+	// ResultFamily if set suppresses entries without an address of the
+	// given family. It is independent of the families queried over.
+	ResultFamily AddressFamily
+
+	// InfoSeparator is used to join the TXT strings into the Info of
+	// the entries resolved, both those emitted and those a Client keeps
+	// for Entries, InProgress and Browse. Defaults to "|".
+	InfoSeparator string
+
+	// Logger if set receives the log output of the query, overriding
+	// the package Logger
+	Logger *log.Logger
+
+	// MulticastTTL is the IP TTL, or IPv6 hop limit, of the multicast
+	// queries. A value above one lets queries cross routers forwarding
+	// multicast. Defaults to 255, as recommended by RFC 6762.
+	MulticastTTL int
+
+	// ParallelSend writes each query to the IPv4 and IPv6 sockets
+	// concurrently rather than one after the other, so a slow write on
+	// one family does not delay the other
+	ParallelSend bool
+}
+
+// DefaultParams is used to return a default set of QueryParam's
+func DefaultParams(service string) *QueryParam {
+	return &QueryParam{
+		Service: service,
+		Domain:  "local",
+		Timeout: time.Second,
+		Entries: make(chan *ServiceEntry),
+		Retries: 3,
+	}
+}
+
+// validate is used to check the parameters of a service query, and to
+// set the defaults of the Domain and Timeout
+func (p *QueryParam) validate() error {
+	if p.Service == "" {
+		return fmt.Errorf("Invalid query parameters: Service is required")
+	}
+	if p.Entries == nil {
+		return fmt.Errorf("Invalid query parameters: Entries is required")
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("Invalid query parameters: Timeout %v is negative", p.Timeout)
+	}
+	if p.Domain == "" {
+		p.Domain = "local"
+	}
+	if p.Timeout == 0 {
+		p.Timeout = time.Second
+	}
+	return nil
+}
+
+// Query looks up a given service, in a domain, waiting at most
+// for a timeout before finishing the query. The results are streamed
+// to a channel. Sends will not block, so clients should make sure to
+// either read or buffer.
+func Query(params *QueryParam) error {
+	return QueryContext(context.Background(), params)
+}
+
+// QueryContext is like Query, but also stops early with the context's
+// error once the context is done. The timeout still bounds the query.
+func QueryContext(ctx context.Context, params *QueryParam) error {
+	if err := params.validate(); err != nil {
+		return err
+	}
+
+	// Create a new client
+	client, err := newClient(params.DisableIPv4, params.DisableIPv6)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Run the query
+	return client.QueryContext(ctx, params)
+}
+
+// QueryName is like Query, but asks the given fully-qualified question
+// name and type verbatim instead of assembling the name from the
+// Service and Domain parameters, which are ignored
+func QueryName(name string, qtype uint16, params *QueryParam) error {
+	// Create a new client
+	client, err := newClient(params.DisableIPv4, params.DisableIPv6)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Run the query
+	return client.QueryName(name, qtype, params)
+}
+
+// ResolveInstance resolves a single instance by its fully-qualified name,
+// such as "hostname._http._tcp.local.", without browsing its service.
+// It asks for all of the instance's records, returning the entry as soon
+// as it is complete, or an error if it is not within the timeout.
+func ResolveInstance(instance string, timeout time.Duration) (*ServiceEntry, error) {
+	// Create a new client
+	client, err := NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return resolveInstance(instance, timeout, func(ctx context.Context, name string, params *QueryParam) error {
+		return client.queryNames(ctx, []string{name}, dns.TypeANY, params)
+	})
+}
+
+// resolveInstance is used to wait for the first entry for an instance
+// name from a query run with the given query function
+func resolveInstance(instance string, timeout time.Duration,
+	query func(context.Context, string, *QueryParam) error) (*ServiceEntry, error) {
+	name := instance
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	entries := make(chan *ServiceEntry, 32)
+	params := DefaultParams("")
+	params.Entries = entries
+	params.Timeout = timeout
+
+	// Run the query, stopping it once the instance is resolved
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- query(ctx, name, params)
+	}()
+	match := func(e *ServiceEntry) bool {
+		return nameKey(e.Name) == nameKey(name)
+	}
+	for {
+		select {
+		case e := <-entries:
+			if match(e) {
+				cancel()
+				<-errCh
+				return e, nil
+			}
+		case err := <-errCh:
+			// Check the entries emitted just before the query ended
+			for len(entries) > 0 {
+				if e := <-entries; match(e) {
+					return e, nil
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Timed out resolving instance %s", name)
+		}
+	}
+}
+
+// CountInstances browses for a service with a PTR query, returning the
+// number of distinct instances that answered within the timeout. The
+// instances are not resolved, making this cheaper than a Query.
+func CountInstances(service, domain string, timeout time.Duration) (int, error) {
+	// Create a new client
+	client, err := NewClient()
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	if domain == "" {
+		domain = "local"
+	}
+	serviceAddr := fmt.Sprintf("%s.%s.", trimDot(service), trimDot(domain))
+
+	client.queryLock.Lock()
+	defer client.queryLock.Unlock()
+	return countInstances(serviceAddr, timeout, client.msgCh, client.sendQuery)
+}
+
+// countInstances is used to count the distinct PTR targets for a
+// service name, without any follow up queries
+func countInstances(name string, timeout time.Duration, msgCh <-chan *msgAddr, send sendFunc) (int, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypePTR)
+	m.RecursionDesired = false
+	if err := send(m); err != nil {
+		return 0, err
+	}
+
+	seen := make(map[string]struct{})
+	finish := time.After(timeout)
+	for {
+		select {
+		case resp := <-msgCh:
+			for _, answer := range resp.msg.Answer {
+				if ptr, ok := answer.(*dns.PTR); ok && ptr.Hdr.Name == name {
+					seen[ptr.Ptr] = struct{}{}
+				}
+			}
+		case <-finish:
+			return len(seen), nil
+		}
+	}
+}
+
+// Exists browses for a service with a PTR query, returning true as soon
+// as any instance answers, or false once the timeout passes without one.
+// Nothing is resolved, making this the cheapest presence check.
+func Exists(service, domain string, timeout time.Duration) (bool, error) {
+	// Create a new client
+	client, err := NewClient()
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	if domain == "" {
+		domain = "local"
+	}
+	serviceAddr := fmt.Sprintf("%s.%s.", trimDot(service), trimDot(domain))
+
+	client.queryLock.Lock()
+	defer client.queryLock.Unlock()
+	return serviceExists(serviceAddr, timeout, client.msgCh, client.sendQuery)
+}
+
+// serviceExists is used to wait for the first PTR answer for a service
+// name, without any follow up queries. Goodbye PTRs with a zero TTL are
+// ignored, as they announce that an instance is going away
+func serviceExists(name string, timeout time.Duration, msgCh <-chan *msgAddr, send sendFunc) (bool, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypePTR)
+	m.RecursionDesired = false
+	if err := send(m); err != nil {
+		return false, err
+	}
+
+	finish := time.After(timeout)
+	for {
+		select {
+		case resp := <-msgCh:
+			for _, answer := range resp.msg.Answer {
+				if ptr, ok := answer.(*dns.PTR); ok && ptr.Hdr.Name == name && ptr.Hdr.Ttl != 0 {
+					return true, nil
+				}
+			}
+		case <-finish:
+			return false, nil
+		}
+	}
+}
+
+// interfaces is used to list the host interfaces, and may be
+// replaced for testing
+var interfaces = net.Interfaces
+
+// IsAvailable reports whether mDNS can plausibly work on this host,
+// which requires a non-loopback interface that is up and multicast
+// capable. This allows an early exit where discovery cannot succeed.
+func IsAvailable() (bool, error) {
+	ifaces, err := interfaces()
+	if err != nil {
+		return false, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if iface.Flags&net.FlagMulticast != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Lookup is the same as Query, however it uses all the default parameters
+func Lookup(service string, entries chan<- *ServiceEntry) error {
+	params := DefaultParams(service)
+	params.Entries = entries
+	return Query(params)
+}
+
+// LookupAll browses for a service in a domain, returning the instances
+// found within the timeout. Each instance is returned once, in the
+// last revision received, sorted as by SortEntries.
+func LookupAll(service, domain string, timeout time.Duration) ([]*ServiceEntry, error) {
+	return lookupAll(service, domain, timeout, Query)
+}
+
+// LookupMap is like LookupAll, but returns the instances keyed by name.
+// Instances whose last revision had expired, such as those that sent a
+// goodbye, are left out.
+func LookupMap(service, domain string, timeout time.Duration) (map[string]*ServiceEntry, error) {
+	return lookupMap(service, domain, timeout, Query)
+}
+
+// LookupOnInterface is like LookupAll in the local domain, but sends the
+// queries out of the named interface only, such as a VLAN interface, and
+// returns just the instances with an address on one of its networks.
+func LookupOnInterface(service, ifName string, timeout time.Duration) ([]*ServiceEntry, error) {
+	return lookupOnInterface(service, ifName, timeout, Query)
+}
+
+// lookupOnInterface is used to collect the entries of a query run with
+// the given query function on the named interface
+func lookupOnInterface(service, ifName string, timeout time.Duration,
+	query func(*QueryParam) error) ([]*ServiceEntry, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find interface %s: %v", ifName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get addresses of interface %s: %v", ifName, err)
+	}
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			nets = append(nets, ipnet)
+		}
+	}
+
+	found, err := lookupAll(service, "", timeout, func(params *QueryParam) error {
+		params.Interface = iface
+		return query(params)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []*ServiceEntry
+	for _, e := range found {
+		if onInterface(e, iface.Name, nets) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// onInterface is used to check if an entry has an address reachable on
+// the named interface, either within one of its networks or link-local
+// and scoped to it
+func onInterface(e *ServiceEntry, name string, nets []*net.IPNet) bool {
+	if e.AddrV6 != nil && e.AddrV6.IsLinkLocalUnicast() && e.AddrZone == name {
+		return true
+	}
+	for _, ipnet := range nets {
+		if (e.AddrV4 != nil && ipnet.Contains(e.AddrV4)) ||
+			(e.AddrV6 != nil && ipnet.Contains(e.AddrV6)) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupMap is used to collect the live entries of a query run with the
+// given query function into a map
+func lookupMap(service, domain string, timeout time.Duration,
+	query func(*QueryParam) error) (map[string]*ServiceEntry, error) {
+	found, err := lookupAll(service, domain, timeout, query)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	out := make(map[string]*ServiceEntry, len(found))
+	for _, e := range found {
+		if e.Expired || (!e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)) {
+			continue
+		}
+		out[e.Name] = e
+	}
+	return out, nil
+}
+
+// lookupAll is used to collect the entries of a query run with the
+// given query function
+func lookupAll(service, domain string, timeout time.Duration,
+	query func(*QueryParam) error) ([]*ServiceEntry, error) {
+	entries := make(chan *ServiceEntry, 32)
+	params := DefaultParams(service)
+	params.Entries = entries
+	params.Timeout = timeout
+	if domain != "" {
+		params.Domain = domain
+	}
+
+	// Run the query, draining its entries as they arrive
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- query(params)
+		close(entries)
+	}()
+	var found []*ServiceEntry
+	index := make(map[string]int)
+	for e := range entries {
+		if i, ok := index[e.Name]; ok {
+			found[i] = e
+			continue
+		}
+		index[e.Name] = len(found)
+		found = append(found, e)
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	SortEntries(found)
+	return found, nil
+}
+
+// Client provides a query interface that can be used to
+// search for service providers using mDNS. A Client may be
+// reused for many queries, which are run one at a time.
+type Client struct {
+	// RebindInterval if non-zero causes the client to rebind its
+	// sockets to fresh source ports before a query, once the current
+	// ports have been in use for at least this long. This avoids
+	// responses being dropped by stateful firewalls after idle periods.
+	RebindInterval time.Duration
+
+	// ExpiredRetention is how long entries returned by Entries are kept
+	// after they expire, flagged as Expired, before being removed
+	ExpiredRetention time.Duration
+
+	// RefreshWindow if non-zero causes the maintenance goroutine started
+	// by StartMaintenance to re-query cached entries that will expire
+	// within this window
+	RefreshWindow time.Duration
+
+	// MaxEntryAge if non-zero evicts entries last seen longer ago than
+	// this, whatever their TTL, bounding how stale the entries returned
+	// by Entries can be when responders advertise very long TTLs
+	MaxEntryAge time.Duration
+
+	// disableIPv4 and disableIPv6 skip binding the address family
+	disableIPv4 bool
+	disableIPv6 bool
+
+	ipv4List *net.UDPConn
+	ipv6List *net.UDPConn
+	lastBind time.Time
+	msgCh    chan *msgAddr
+
+	// lastQuery is the state of the most recent query
+	lastQuery *queryState
+
+	// cache retains the entries resolved across queries
+	cache *entryCache
+
+	queryLock sync.Mutex
+
+	closed    bool
+	closedCh  chan struct{}
+	closeLock sync.Mutex
+
+	// maintaining is set once StartMaintenance has been called
+	maintaining bool
+
+	// wg tracks the receive and maintenance goroutines, so Close can
+	// wait for them
+	wg sync.WaitGroup
+}
+
+// NewClient creates a new mdns Client that can be used to query
+// for records
+func NewClient() (*Client, error) {
+	return newClient(false, false)
+}
+
+// newClient is used to create a client, without binding sockets for
+// the disabled address families
+func newClient(disableIPv4, disableIPv6 bool) (*Client, error) {
+	if disableIPv4 && disableIPv6 {
+		return nil, fmt.Errorf("Cannot disable both IPv4 and IPv6")
+	}
+	ipv4, ipv6, err := bindClient(disableIPv4, disableIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		disableIPv4: disableIPv4,
+		disableIPv6: disableIPv6,
+		ipv4List:    ipv4,
+		ipv6List:    ipv6,
+		lastBind:    time.Now(),
+		msgCh:       make(chan *msgAddr, 32),
+		cache:       newEntryCache(),
+		closedCh:    make(chan struct{}),
+	}
+	c.startRecv(c.ipv4List)
+	c.startRecv(c.ipv6List)
+	return c, nil
+}
+
+// bindClient is used to bind the client sockets to ephemeral ports,
+// skipping any disabled address family
+func bindClient(disableIPv4, disableIPv6 bool) (*net.UDPConn, *net.UDPConn, error) {
+	var ipv4, ipv6 *net.UDPConn
+	var err error
+
+	// Create a IPv4 listener
+	if !disableIPv4 {
+		ipv4, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+		if err != nil {
+			logf("[ERR] mdns: Failed to bind to udp4 port: %v", err)
+		}
+	}
+	if !disableIPv6 {
+		ipv6, err = net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6zero, Port: 0})
+		if err != nil {
+			logf("[ERR] mdns: Failed to bind to udp6 port: %v", err)
+		}
+	}
+
+	if ipv4 == nil && ipv6 == nil {
+		return nil, nil, fmt.Errorf("Failed to bind to any udp port!")
+	}
+	return ipv4, ipv6, nil
+}
+
+// Close is used to cleanup the client. It returns once the receive
+// and maintenance goroutines have stopped.
+func (c *Client) Close() error {
+	c.closeLock.Lock()
+	if c.closed {
+		c.closeLock.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.closedCh)
+
+	if c.ipv4List != nil {
+		c.ipv4List.Close()
+	}
+	if c.ipv6List != nil {
+		c.ipv6List.Close()
+	}
+	c.closeLock.Unlock()
+
+	// The receivers check the closed flag, so wait without the lock
+	c.wg.Wait()
+	return nil
+}
+
+// Query looks up a given service using this client. It behaves like
+// the package level Query, but reuses the client's sockets.
+func (c *Client) Query(params *QueryParam) error {
+	return c.QueryContext(context.Background(), params)
+}
+
+// QueryContext looks up a given service using this client, stopping
+// early with the context's error once the context is done
+func (c *Client) QueryContext(ctx context.Context, params *QueryParam) error {
+	if err := params.validate(); err != nil {
+		return err
+	}
+
+	// Create the service names
+	names, err := serviceNames(params.Service, params.Domain)
+	if err != nil {
+		return err
+	}
+	qtype := params.QueryType
+	if qtype == 0 {
+		qtype = dns.TypeANY
+	}
+	return c.queryNames(ctx, names, qtype, params)
+}
+
+// QueryName looks up the given fully-qualified question name and type
+// verbatim using this client, streaming any entries found
+func (c *Client) QueryName(name string, qtype uint16, params *QueryParam) error {
+	return c.queryNames(context.Background(), []string{name}, qtype, params)
+}
+
+// queryNames is used to look up several names in a single query
+func (c *Client) queryNames(ctx context.Context, names []string, qtype uint16, params *QueryParam) error {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+
+	// Rebind if the current ports have been held long enough
+	if c.RebindInterval > 0 && time.Since(c.lastBind) >= c.RebindInterval {
+		if err := c.rebind(); err != nil {
+			return err
+		}
+	}
+
+	// Set the multicast interface, only using the address families
+	// that the interface has addresses for
+	ipv4, ipv6 := c.ipv4List, c.ipv6List
+	if params.Interface != nil {
+		var err error
+		if ipv4, ipv6, err = c.setInterface(params.Interface); err != nil {
+			return err
+		}
+	}
+
+	// Leave out any disabled address family
+	if params.DisableIPv4 {
+		ipv4 = nil
+	}
+	if params.DisableIPv6 {
+		ipv6 = nil
+	}
+	if ipv4 == nil && ipv6 == nil {
+		return fmt.Errorf("No enabled address family to query over")
+	}
+
+	// Set the TTL of the multicast queries
+	ttl := params.MulticastTTL
+	if ttl == 0 {
+		ttl = defaultMulticastTTL
+	}
+	if err := setMulticastTTL(ipv4, ipv6, ttl); err != nil {
+		logf("[WARN] mdns: Failed to set multicast TTL: %v", err)
+	}
+
+	// Ensure defaults are set
+	if params.Timeout == 0 {
+		params.Timeout = time.Second
+	}
+
+	// Run the query
+	return c.query(ctx, names, qtype, params, ipv4, ipv6)
+}
+
+// Reset discards the state the client retains between queries: the
+// entries returned by Entries, the incomplete entries returned by
+// InProgress, and any responses received since the last query. Call it
+// before reusing a client when nothing learned by earlier queries, for
+// example on another network, should carry over to the next.
+func (c *Client) Reset() {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+
+	c.lastQuery = nil
+	c.cache.clear()
+	for drained := false; !drained; {
+		select {
+		case <-c.msgCh:
+		default:
+			drained = true
+		}
+	}
+}
+
+// Rebind replaces the client's sockets with ones bound to fresh
+// ephemeral source ports
+func (c *Client) Rebind() error {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	return c.rebind()
+}
+
+// rebind is used to swap in freshly bound sockets. The query lock
+// must be held.
+func (c *Client) rebind() error {
+	// Bind the new sockets before closing the old ones, so the
+	// new ports are guaranteed to differ
+	ipv4, ipv6, err := bindClient(c.disableIPv4, c.disableIPv6)
+	if err != nil {
+		return err
+	}
+
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	if c.closed {
+		if ipv4 != nil {
+			ipv4.Close()
+		}
+		if ipv6 != nil {
+			ipv6.Close()
+		}
+		return fmt.Errorf("Client is closed")
+	}
+
+	old4, old6 := c.ipv4List, c.ipv6List
+	c.ipv4List, c.ipv6List = ipv4, ipv6
+	c.lastBind = time.Now()
+	c.startRecv(c.ipv4List)
+	c.startRecv(c.ipv6List)
+
+	if old4 != nil {
+		old4.Close()
+	}
+	if old6 != nil {
+		old6.Close()
+	}
+	return nil
+}
+
+// active is used to check if a socket is still in use by the client
+func (c *Client) active(l *net.UDPConn) bool {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	return !c.closed && (l == c.ipv4List || l == c.ipv6List)
+}
+
+// setInterface is used to set the query interface, returning the
+// sockets of the address families the interface has addresses for
+func (c *Client) setInterface(iface *net.Interface) (*net.UDPConn, *net.UDPConn, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get addresses of interface %s: %v", iface.Name, err)
+	}
+	hasV4, hasV6 := addrFamilies(addrs)
+
+	var v4, v6 *net.UDPConn
+	if c.ipv4List != nil && hasV4 {
+		p := ipv4.NewPacketConn(c.ipv4List)
+		if err := p.SetMulticastInterface(iface); err != nil {
+			return nil, nil, err
+		}
+		v4 = c.ipv4List
+	}
+	if c.ipv6List != nil && hasV6 {
+		p2 := ipv6.NewPacketConn(c.ipv6List)
+		if err := p2.SetMulticastInterface(iface); err != nil {
+			return nil, nil, err
+		}
+		v6 = c.ipv6List
+	}
+	if v4 == nil && v6 == nil {
+		return nil, nil, fmt.Errorf("Interface %s has no usable address for the bound address families", iface.Name)
+	}
+	return v4, v6, nil
+}
+
+// defaultMulticastTTL is the TTL of multicast packets recommended by
+// RFC 6762
+const defaultMulticastTTL = 255
+
+// setMulticastTTL is used to set the TTL, or hop limit, of the multicast
+// packets sent on the given sockets, either of which may be nil
+func setMulticastTTL(v4, v6 *net.UDPConn, ttl int) error {
+	if v4 != nil {
+		if err := ipv4.NewPacketConn(v4).SetMulticastTTL(ttl); err != nil {
+			return err
+		}
+	}
+	if v6 != nil {
+		if err := ipv6.NewPacketConn(v6).SetMulticastHopLimit(ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addrFamilies is used to check which address families are present
+// in a list of interface addresses
+func addrFamilies(addrs []net.Addr) (hasV4, hasV6 bool) {
+	for _, addr := range addrs {
+		var ip net.IP
+		switch a := addr.(type) {
+		case *net.IPNet:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		default:
+			continue
+		}
+		if ip.To4() != nil {
+			hasV4 = true
+		} else if ip.To16() != nil {
+			hasV6 = true
+		}
+	}
+	return
+}
+
+// msgAddr is used to pair a received message with its source
+type msgAddr struct {
+	msg *dns.Msg
+	src net.Addr
+}
+
+// sendFunc is used to transmit an outbound query message
+type sendFunc func(q *dns.Msg) error
+
+// query is used to perform a lookup over the given UDP sockets, either
+// of which may be nil, and stream results
+func (c *Client) query(ctx context.Context, names []string, qtype uint16, params *QueryParam, ipv4, ipv6 *net.UDPConn) error {
+	c.lastQuery = c.newQueryState(ctx, names, params, ipv4, ipv6)
+	return runQuery(names[0], qtype, c.lastQuery, c.msgCh)
+}
+
+// newQueryState is used to create the state of a query over the given
+// UDP sockets, discarding any responses left over from a previous query
+func (c *Client) newQueryState(ctx context.Context, names []string, params *QueryParam, ipv4, ipv6 *net.UDPConn) *queryState {
+	for drained := false; !drained; {
+		select {
+		case <-c.msgCh:
+		default:
+			drained = true
+		}
+	}
+
+	mc := newMulticaster(ipv4, ipv6)
+	mc.parallel = params.ParallelSend
+	state := newQueryState(params, mc.send)
+	state.sendV4 = mc.sendV4
+	state.sendV6 = mc.sendV6
+	mc.onUnreachable = state.sendError
+	mc.logf = state.logf
+	state.sendTo = c.sendQueryTo
+	state.observe = c.cache.update
+	state.alsoAsk = names[1:]
+	state.ctx = ctx
+	return state
+}
+
+// SetUserData attaches caller state to a resolved instance, to be
+// carried by the later revisions of it that the client emits or returns
+// from Entries. It returns false if the instance is unknown.
+func (c *Client) SetUserData(name string, data interface{}) bool {
+	return c.cache.setUserData(name, data)
+}
+
+// Entries returns the entries resolved by the client's queries that
+// have not yet expired, along with those that expired within the
+// ExpiredRetention window, which are flagged as Expired
+func (c *Client) Entries() []*ServiceEntry {
+	return c.snapshot(time.Now())
+}
+
+// snapshot is used to evict the entries that are too old or expired
+// as of now, and return copies of the rest
+func (c *Client) snapshot(now time.Time) []*ServiceEntry {
+	if c.MaxEntryAge > 0 {
+		c.cache.evictSeenBefore(now.Add(-c.MaxEntryAge))
+	}
+	return c.cache.snapshot(now, c.ExpiredRetention)
+}
+
+// StartMaintenance starts a goroutine that evicts expired entries from
+// the client's cache every interval, and re-queries those expiring
+// within RefreshWindow. It is stopped by Close, and calling it again
+// has no effect.
+func (c *Client) StartMaintenance(interval time.Duration) {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	if c.closed || c.maintaining {
+		return
+	}
+	c.maintaining = true
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.maintain(interval)
+	}()
+}
+
+// maintain is used to run the cache maintenance until the client closes
+func (c *Client) maintain(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.maintainOnce(now)
+		case <-c.closedCh:
+			return
+		}
+	}
+}
+
+// maintainOnce is used to evict the expired entries, and refresh the
+// ones about to expire if a RefreshWindow is set
+func (c *Client) maintainOnce(now time.Time) {
+	entries := c.snapshot(now)
+	if c.RefreshWindow <= 0 {
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Expired || e.ExpiresAt.Sub(now) >= c.RefreshWindow {
+			continue
+		}
+		names = append(names, e.Name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	if err := c.refresh(names); err != nil {
+		logf("[ERR] mdns: Failed to refresh entries: %v", err)
+	}
+}
+
+// refreshTimeout is how long a refresh listens for responses, and may be
+// replaced for testing
+var refreshTimeout = time.Second
+
+// refresh is used to re-query the given instance names with a single
+// message, recording the responses in the cache. Being internal, it
+// leaves the state of the last query reported by Stats and InProgress
+// alone.
+func (c *Client) refresh(names []string) error {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+
+	params := &QueryParam{
+		Timeout: refreshTimeout,
+		Entries: make(chan *ServiceEntry, len(names)),
+	}
+	state := c.newQueryState(context.Background(), names, params, c.ipv4List, c.ipv6List)
+	return runQuery(names[0], dns.TypeANY, state, c.msgCh)
+}
+
+// QueryStats describes the responses handled by a query
+type QueryStats struct {
+	// RecordTypes counts the records received of each type, such as
+	// dns.TypePTR or dns.TypeOPT, across all sections of the responses.
+	// This helps to diagnose responders sending unexpected records.
+	RecordTypes map[uint16]int
+}
+
+// Stats returns the statistics of the most recent query
+func (c *Client) Stats() QueryStats {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	stats := QueryStats{RecordTypes: make(map[uint16]int)}
+	if c.lastQuery == nil {
+		return stats
+	}
+	for rrtype, n := range c.lastQuery.recordTypes {
+		stats.RecordTypes[rrtype] = n
+	}
+	return stats
+}
+
+// InProgress returns copies of the entries that were still incomplete
+// when the most recent query finished, with whatever fields had been
+// gathered. This helps to diagnose why an instance was not returned.
+func (c *Client) InProgress() []*ServiceEntry {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	if c.lastQuery == nil {
+		return nil
+	}
+
+	var out []*ServiceEntry
+	for _, inp := range c.lastQuery.inprogress {
+		if inp.complete() {
+			continue
+		}
+		dup := *inp
+		dup.Incomplete = true
+		out = append(out, &dup)
+	}
+	SortEntries(out)
+	return out
+}
+
+// runQuery is used to perform a lookup of a question and stream results.
+// It is independent of the transport: queries are transmitted using the
+// state's send function, and responses are read from msgCh.
+func runQuery(name string, qtype uint16, state *queryState, msgCh <-chan *msgAddr) error {
+	params := state.params
+	if err := validateHeader(params); err != nil {
+		return err
+	}
+	state.preferFamily()
+	if params.Metrics != nil {
+		state.instrument()
+		defer func(start time.Time) {
+			params.Metrics.ObserveQueryDuration(time.Since(start))
+		}(time.Now())
+	}
+
+	// Wait for the network to be ready
+	if params.ReadyCheck != nil {
+		waitReady(params.ReadyCheck, params.ReadyTimeout)
+	}
+
+	// Send the query
+	m := state.newMsg(name, qtype)
+	for _, also := range state.alsoAsk {
+		m.Question = append(m.Question, dns.Question{
+			Name:   also,
+			Qtype:  qtype,
+			Qclass: state.qclass(),
+		})
+	}
+	state.sentIDs[m.Id] = struct{}{}
+	if err := state.send(m); err != nil {
+		if state.fallback == nil {
+			return err
+		}
+
+		// Fall back to the other address family straight away if the
+		// preferred one cannot be sent over, such as without a route
+		state.sendError(fmt.Errorf("Failed to send query over preferred family, falling back: %v", err))
+		state.send, state.fallback = state.fallback, nil
+		if err := state.send(m); err != nil {
+			return err
+		}
+	}
+
+	// Fall back to the other address family if the preferred one is
+	// silent for the grace period
+	var fallback <-chan time.Time
+	if state.fallback != nil {
+		grace := params.FamilyGrace
+		if grace == 0 {
+			grace = defaultFamilyGrace
+		}
+		fallback = time.After(grace)
+	}
+
+	// Retransmit the query in case it was lost
+	var retry <-chan time.Time
+	retries, backoff := params.Retries, retryInterval
+	if retries > 0 {
+		retry = time.After(backoff)
+	}
+
+	// Stop early if the context is done
+	var done <-chan struct{}
+	if state.ctx != nil {
+		done = state.ctx.Done()
+	}
+
+	// Listen until we reach the timeout
+	state.deadline = time.Now().Add(params.Timeout)
+	finish := time.After(params.Timeout)
+	requeried := false
+	for {
+		select {
+		case resp := <-msgCh:
+			if !state.accept(resp) {
+				continue
+			}
+			fallback = nil
+			state.handleResponse(resp.msg, resp.src)
+
+			// Reissue the service query to flush out stragglers
+			if params.ReQueryOnFirstResponse && !requeried {
+				requeried = true
+				if err := state.send(m); err != nil {
+					state.sendError(fmt.Errorf("Failed to reissue query: %v", err))
+				}
+			}
+		case <-fallback:
+			fallback = nil
+			state.send = state.fallback
+			if err := state.send(m); err != nil {
+				state.sendError(fmt.Errorf("Failed to send fallback query: %v", err))
+			}
+		case <-retry:
+			if err := state.send(m); err != nil {
+				state.sendError(fmt.Errorf("Failed to retransmit query: %v", err))
+			}
+			retry = nil
+			if retries--; retries > 0 {
+				backoff *= 2
+				retry = time.After(backoff)
+			}
+		case <-done:
+			return state.ctx.Err()
+		case <-finish:
+			if params.DrainOnTimeout {
+				state.drain(msgCh)
+			}
+			return nil
+		}
+	}
+}
+
+// retryInterval is the delay before the first retransmit of a query
+const retryInterval = 100 * time.Millisecond
+
+// waitReady is used to poll check until it succeeds or the timeout
+// elapses, returning whether it succeeded
+func waitReady(check func() bool, timeout time.Duration) bool {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			logf("[WARN] mdns: Network not ready after %v, querying anyway", timeout)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// drainWindow bounds how long responses are drained after a timeout
+const drainWindow = 10 * time.Millisecond
+
+// drain is used to process any responses already received, stopping
+// once none are queued or the drain window passes
+func (q *queryState) drain(msgCh <-chan *msgAddr) {
+	deadline := time.Now().Add(drainWindow)
+	for time.Now().Before(deadline) {
+		select {
+		case resp := <-msgCh:
+			if q.accept(resp) {
+				q.handleResponse(resp.msg, resp.src)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// preferFamily is used to restrict sends to the preferred address family
+// of the FamilyStrategy, keeping the other family as the fallback
+func (q *queryState) preferFamily() {
+	var preferred, other sendFunc
+	switch q.params.FamilyStrategy {
+	case V6ThenV4:
+		preferred, other = q.sendV6, q.sendV4
+	case V4ThenV6:
+		preferred, other = q.sendV4, q.sendV6
+	}
+	if preferred == nil || other == nil {
+		return
+	}
+	q.send, q.fallback = preferred, other
+}
+
+// instrument is used to wrap the send functions to record metrics
+func (q *queryState) instrument() {
+	metrics, send, sendTo, fallback := q.params.Metrics, q.send, q.sendTo, q.fallback
+	q.send = func(m *dns.Msg) error {
+		metrics.IncQueriesSent()
+		return send(m)
+	}
+	if fallback != nil {
+		q.fallback = func(m *dns.Msg) error {
+			metrics.IncQueriesSent()
+			return fallback(m)
+		}
+	}
+	if sendTo != nil {
+		q.sendTo = func(m *dns.Msg, addr net.Addr) error {
+			metrics.IncQueriesSent()
+			return sendTo(m, addr)
+		}
+	}
+}
+
+// accept is used to check if a response should be processed. The
+// message ID is deliberately not checked: multicast responses should
+// use an ID of zero, but some responders echo the query ID or pick
+// their own, and all of them are answers we want.
+func (q *queryState) accept(resp *msgAddr) bool {
+	// Drop responses from other sources if restricted
+	if q.params.RestrictSource != nil && !fromSource(resp.src, q.params.RestrictSource) {
+		return false
+	}
+
+	// Multicast responses are accepted whatever their ID, as some
+	// responders echo the query's ID rather than using zero. Responders
+	// queried directly must answer with the ID of a query sent.
+	if ids, ok := q.unicastIDs[addrKey(resp.src)]; ok && resp.msg.Id != 0 {
+		_, unicast := ids[resp.msg.Id]
+		_, multicast := q.sentIDs[resp.msg.Id]
+		if !unicast && !multicast {
+			q.logf("[WARN] mdns: Dropping response from %v with unknown ID %d", resp.src, resp.msg.Id)
+			return false
+		}
+	}
+	if q.params.Metrics != nil {
+		q.params.Metrics.IncResponsesReceived()
+	}
+	return true
+}
+
+// addrKey is used to get the key of a source address
+func addrKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// fromSource is used to check if an address has the given IP
+func fromSource(addr net.Addr, ip net.IP) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	return ok && udpAddr.IP.Equal(ip)
+}
+
+// queryState tracks the entries of a single query
+type queryState struct {
+	params *QueryParam
+	send   sendFunc
+
+	// sendTo if set is used to send unicast follow up queries
+	sendTo func(q *dns.Msg, addr net.Addr) error
+
+	// alsoAsk holds further names asked about in the initial query
+	alsoAsk []string
+
+	// ctx if set stops the query early once done
+	ctx context.Context
+
+	// deadline is when the query times out, bounding blocking deliveries
+	deadline time.Time
+
+	// sendV4 and sendV6 if set are used to send over a single address
+	// family, and fallback is the send used if the preferred family of
+	// the FamilyStrategy gets no response
+	sendV4   sendFunc
+	sendV6   sendFunc
+	fallback sendFunc
+
+	// inprogress maps names to the entries being resolved
+	inprogress map[string]*ServiceEntry
+
+	// emitted holds the dedup keys of the entries emitted so far
+	emitted map[string]struct{}
+
+	// followedUp holds when a follow up query was last sent per name
+	followedUp map[string]time.Time
 
-// complete is used to check if we have all the info we need
-func (s *ServiceEntry) complete() bool {
-	return s.Addr != nil && s.Port != 0 && s.hasTXT
-}
+	// observe if set is called with every complete entry that a
+	// response touched, whether or not it is emitted
+	observe func(*ServiceEntry)
 
-// QueryParam is used to customize how a Lookup is performed
-type QueryParam struct {
-	Service   string               // Service to lookup
-	Domain    string               // Lookup domain, default "local"
-	Timeout   time.Duration        // Lookup timeout, default 1 second
-	Interface *net.Interface       // Multicast interface to use
-	Entries   chan<- *ServiceEntry // Entries Channel
+	// responded is set once the first response is handled
+	responded bool
+
+	// rotation is the padding length of the last rotated query
+	rotation int
+
+	// recordTypes counts the records received per type
+	recordTypes map[uint16]int
+
+	// sentIDs holds the IDs of the multicast queries sent, and
+	// unicastIDs those of the queries sent to each responder directly
+	sentIDs    map[uint16]struct{}
+	unicastIDs map[string]map[uint16]struct{}
 }
 
-// DefaultParams is used to return a default set of QueryParam's
-func DefaultParams(service string) *QueryParam {
-	return &QueryParam{
-		Service: service,
-		Domain:  "local",
-		Timeout: time.Second,
-		Entries: make(chan *ServiceEntry),
+// newQueryState is used to create the state for a new query
+func newQueryState(params *QueryParam, send sendFunc) *queryState {
+	return &queryState{
+		params:      params,
+		send:        send,
+		inprogress:  make(map[string]*ServiceEntry),
+		emitted:     make(map[string]struct{}),
+		followedUp:  make(map[string]time.Time),
+		rotation:    rand.Intn(maxQueryPadding),
+		recordTypes: make(map[uint16]int),
+		sentIDs:     make(map[uint16]struct{}),
+		unicastIDs:  make(map[string]map[uint16]struct{}),
 	}
 }
 
-// Query looks up a given service, in a domain, waiting at most
-// for a timeout before finishing the query. The results are streamed
-// to a channel. Sends will not block, so clients should make sure to
-// either read or buffer.
-func Query(params *QueryParam) error {
-	// Create a new client
-	client, err := newClient()
-	if err != nil {
-		return err
+// handleResponse is used to merge the records of a response, from both
+// the answer and additional sections, into the in-progress entries.
+// Responders may spread the records of an instance across several
+// packets, so every entry touched by this packet is re-evaluated and
+// emitted as soon as it becomes complete.
+func (q *queryState) handleResponse(resp *dns.Msg, from net.Addr) {
+	if !q.responded {
+		q.responded = true
+		if q.params.OnFirstResponse != nil {
+			q.params.OnFirstResponse()
+		}
 	}
-	defer client.Close()
 
-	// Set the multicast interface
-	if params.Interface != nil {
-		if err := client.setInterface(params.Interface); err != nil {
-			return err
+	now := time.Now()
+	signed := q.params.DNSSEC && q.signed(resp)
+	var touched []*ServiceEntry
+	addrs := make(map[*ServiceEntry][]net.IP) // Addresses in this response
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, answer := range section {
+			q.recordTypes[answer.Header().Rrtype]++
+			inp := mergeRecord(q.inprogress, answer, q.params.MaxTrackedInstances)
+			if inp == nil {
+				continue
+			}
+			switch rr := answer.(type) {
+			case *dns.A:
+				addrs[inp] = append(addrs[inp], rr.A)
+			case *dns.AAAA:
+				inp.AddrZone = q.zone(rr.AAAA, from)
+				addrs[inp] = append(addrs[inp], rr.AAAA)
+			case *dns.TXT:
+				if sep := q.params.InfoSeparator; sep != "" {
+					inp.Info = strings.Join(rr.Txt, sep)
+				}
+			}
+			inp.Signed = signed && (inp.LastSeen.IsZero() || inp.Signed)
+			inp.LastSeen = now
+			touched = appendEntry(touched, inp)
 		}
 	}
 
-	// Ensure defaults are set
-	if params.Domain == "" {
-		params.Domain = "local"
-	}
-	if params.Timeout == 0 {
-		params.Timeout = time.Second
+	for _, inp := range touched {
+		if inp.keepEmitted(addrs[inp]) {
+			inp.AddrZone = q.zone(inp.AddrV6, from)
+		}
+		if !inp.complete() {
+			// Fire off a node specific query
+			if !inp.sent {
+				q.query(inp, from)
+			}
+			continue
+		}
+
+		inp.refreshExpiry(now)
+		if q.observe != nil {
+			q.observe(inp)
+		}
+
+		// Hold back entries without an address of the wanted family,
+		// until one arrives
+		if !q.hasFamily(inp) {
+			continue
+		}
+
+		// Flag an address change since the entry was last emitted, if
+		// asked to report them
+		if q.params.ReportAddressChanges {
+			inp.PreviousAddr = inp.addrChange()
+			inp.AddressChanged = inp.PreviousAddr != nil
+		}
+
+		// Emit the entry unless an equivalent one was already emitted
+		key := q.dedupKey(inp)
+		if _, ok := q.emitted[key]; !ok {
+			q.emitted[key] = struct{}{}
+			inp.sent = true
+			inp.txtUpdated = false
+			q.emit(inp)
+			inp.markEmitted()
+			continue
+		}
+
+		// Entries already emitted are only emitted again if their TXT
+		// or address changed, or they said goodbye, which needs no
+		// further resolution
+		if inp.txtUpdated || inp.AddressChanged || inp.goodbye != inp.emittedGoodbye {
+			inp.txtUpdated = false
+			q.emit(inp)
+			inp.ChangedKeys = nil
+			inp.markEmitted()
+		}
 	}
+}
 
-	// Run the query
-	return client.query(params)
+// zone is used to find the zone of a link-local address received from
+// the given source, which is the interface the response arrived on
+func (q *queryState) zone(ip net.IP, from net.Addr) string {
+	if !ip.IsLinkLocalUnicast() {
+		return ""
+	}
+	if addr, ok := from.(*net.UDPAddr); ok && addr.Zone != "" {
+		return addr.Zone
+	}
+	if q.params.Interface != nil {
+		return q.params.Interface.Name
+	}
+	return ""
 }
 
-// Lookup is the same as Query, however it uses all the default parameters
-func Lookup(service string, entries chan<- *ServiceEntry) error {
-	params := DefaultParams(service)
-	params.Entries = entries
-	return Query(params)
+// hasFamily is used to check if an entry has an address of the family
+// wanted by ResultFamily
+func (q *queryState) hasFamily(inp *ServiceEntry) bool {
+	switch q.params.ResultFamily {
+	case IPv4Family:
+		return inp.AddrV4 != nil
+	case IPv6Family:
+		return inp.AddrV6 != nil
+	}
+	return true
 }
 
-// Client provides a query interface that can be used to
-// search for service providers using mDNS
-type client struct {
-	ipv4List *net.UDPConn
-	ipv6List *net.UDPConn
+// signed is used to check if a response carries signatures that pass
+// validation
+func (q *queryState) signed(resp *dns.Msg) bool {
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if _, ok := rr.(*dns.RRSIG); ok {
+				return q.params.Validate == nil || q.params.Validate(resp)
+			}
+		}
+	}
+	return false
+}
 
-	closed    bool
-	closedCh  chan struct{}
-	closeLock sync.Mutex
+// dedupKey is used to get the key deciding if entries are equivalent
+func (q *queryState) dedupKey(inp *ServiceEntry) string {
+	if q.params.DedupKey != nil {
+		return q.params.DedupKey(inp)
+	}
+	return inp.Name
 }
 
-// NewClient creates a new mdns Client that can be used to query
-// for records
-func newClient() (*client, error) {
-	// Create a IPv4 listener
-	ipv4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-	if err != nil {
-		log.Printf("[ERR] mdns: Failed to bind to udp4 port: %v", err)
+// emit is used to stream a snapshot of an entry without blocking. A
+// copy is sent, so that later records do not alter emitted entries.
+func (q *queryState) emit(inp *ServiceEntry) {
+	out := *inp
+	if q.params.StripTrailingDot {
+		out.Name = strings.TrimSuffix(out.Name, ".")
 	}
-	ipv6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6zero, Port: 0})
-	if err != nil {
-		log.Printf("[ERR] mdns: Failed to bind to udp6 port: %v", err)
+	if !q.params.BlockUntilSent {
+		select {
+		case q.params.Entries <- &out:
+		default:
+		}
+		return
 	}
 
-	if ipv4 == nil && ipv6 == nil {
-		return nil, fmt.Errorf("Failed to bind to any udp port!")
+	// Wait for the reader, but not beyond the end of the query
+	wait := q.params.DeliveryTimeout
+	if wait == 0 {
+		wait = defaultDeliveryTimeout
+	}
+	if !q.deadline.IsZero() {
+		if remaining := q.deadline.Sub(time.Now()); remaining < wait {
+			wait = remaining
+		}
 	}
+	var done <-chan struct{}
+	if q.ctx != nil {
+		done = q.ctx.Done()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case q.params.Entries <- &out:
+	case <-timer.C:
+		q.logf("[WARN] mdns: Dropped entry %s, the reader is not ready", out.Name)
+	case <-done:
+	}
+}
 
-	c := &client{
-		ipv4List: ipv4,
-		ipv6List: ipv6,
-		closedCh: make(chan struct{}),
+// newMsg is used to create a query message with the requested header.
+// The ID is zero, as RFC 6762 recommends for multicast queries.
+func (q *queryState) newMsg(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Id = 0
+	m.Question[0].Qclass = q.qclass()
+	m.Opcode = q.params.Opcode
+	m.Authoritative = q.params.Authoritative
+	m.RecursionDesired = q.params.RecursionDesired
+	m.Compress = !q.params.DisableCompression
+	if q.params.DNSSEC {
+		m.SetEdns0(queryUDPSize, true)
 	}
-	return c, nil
+	if q.params.RotateQueries {
+		q.rotate(m)
+	}
+	return m
 }
 
-// Close is used to cleanup the client
-func (c *client) Close() error {
-	c.closeLock.Lock()
-	defer c.closeLock.Unlock()
+// unicastResponseBit is the top bit of a question's class, set to ask
+// for a unicast response
+const unicastResponseBit = 1 << 15
 
-	if c.closed {
-		return nil
+// qclass is used to get the class of the questions asked
+func (q *queryState) qclass() uint16 {
+	if q.params.WantUnicastResponse {
+		return dns.ClassINET | unicastResponseBit
 	}
-	c.closed = true
-	close(c.closedCh)
+	return dns.ClassINET
+}
 
-	if c.ipv4List != nil {
-		c.ipv4List.Close()
-	}
-	if c.ipv6List != nil {
-		c.ipv6List.Close()
+const (
+	// maxQueryPadding bounds the EDNS padding added to rotated queries
+	maxQueryPadding = 16
+
+	// queryUDPSize is the payload size advertised by EDNS queries,
+	// the largest mDNS packet size
+	queryUDPSize = 9000
+)
+
+// rotate is used to pad a query to a different length than the last
+func (q *queryState) rotate(m *dns.Msg) {
+	q.rotation = q.rotation%maxQueryPadding + 1
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(queryUDPSize, false)
+		opt = m.IsEdns0()
 	}
-	return nil
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{
+		Padding: make([]byte, q.rotation),
+	})
 }
 
-// setInterface is used to set the query interface, uses sytem
-// default if not provided
-func (c *client) setInterface(iface *net.Interface) error {
-	p := ipv4.NewPacketConn(c.ipv4List)
-	if err := p.SetMulticastInterface(iface); err != nil {
-		return err
+// validateHeader is used to check the requested query header
+func validateHeader(params *QueryParam) error {
+	switch params.Opcode {
+	case dns.OpcodeQuery, dns.OpcodeIQuery, dns.OpcodeStatus, dns.OpcodeNotify, dns.OpcodeUpdate:
+	default:
+		return fmt.Errorf("Unsupported opcode %d", params.Opcode)
 	}
-	p2 := ipv6.NewPacketConn(c.ipv6List)
-	if err := p2.SetMulticastInterface(iface); err != nil {
-		return err
+	if params.RecursionDesired && params.Opcode != dns.OpcodeQuery {
+		return fmt.Errorf("Recursion desired is only valid for a standard query")
 	}
 	return nil
 }
 
-// query is used to perform a lookup and stream results
-func (c *client) query(params *QueryParam) error {
-	// Create the service name
-	serviceAddr := fmt.Sprintf("%s.%s.", trimDot(params.Service), trimDot(params.Domain))
+// query is used to fire off a node specific query. It is multicast,
+// unless unicast follow ups are enabled and the responder is known.
+func (q *queryState) query(inp *ServiceEntry, from net.Addr) {
+	// Ask for everything, unless ANY questions are to be avoided. Then
+	// the SRV and TXT are asked for, and once the SRV is known, the
+	// addresses of its target.
+	name, key := inp.Name, inp.Name
+	askAll := q.params.QueryType == 0 || q.params.QueryType == dns.TypeANY
+	addrs := !askAll && inp.Port != 0 && inp.AddrV4 == nil && inp.AddrV6 == nil
+	if addrs {
+		if inp.target != "" {
+			name = inp.target
+		}
+		key = name + " addresses"
+	}
 
-	// Start listening for response packets
-	msgCh := make(chan *dns.Msg, 32)
-	go c.recv(c.ipv4List, msgCh)
-	go c.recv(c.ipv6List, msgCh)
+	// Skip names already asked about recently, as several responders
+	// or packets may mention the same instance
+	window := q.params.FollowUpWindow
+	if window == 0 {
+		window = defaultFollowUpWindow
+	}
+	now := time.Now()
+	if last, ok := q.followedUp[key]; ok && now.Sub(last) < window {
+		return
+	}
+	q.followedUp[key] = now
 
-	// Send the query
-	m := new(dns.Msg)
-	m.SetQuestion(serviceAddr, dns.TypeANY)
-	if err := c.sendQuery(m); err != nil {
-		return nil
+	var m *dns.Msg
+	switch {
+	case askAll:
+		m = q.newMsg(name, dns.TypeANY)
+	case addrs:
+		m = q.newMsg(name, dns.TypeA)
+		m.Question = append(m.Question, dns.Question{
+			Name:   name,
+			Qtype:  dns.TypeAAAA,
+			Qclass: q.qclass(),
+		})
+		if !inp.hasTXT {
+			m.Question = append(m.Question, dns.Question{
+				Name:   inp.Name,
+				Qtype:  dns.TypeTXT,
+				Qclass: q.qclass(),
+			})
+		}
+	default:
+		m = q.newMsg(name, dns.TypeSRV)
+		m.Question = append(m.Question, dns.Question{
+			Name:   name,
+			Qtype:  dns.TypeTXT,
+			Qclass: q.qclass(),
+		})
+	}
+	var err error
+	if q.params.UnicastFollowUp && from != nil && q.sendTo != nil {
+		key := addrKey(from)
+		if q.unicastIDs[key] == nil {
+			q.unicastIDs[key] = make(map[uint16]struct{})
+		}
+		m.Id = dns.Id()
+		q.unicastIDs[key][m.Id] = struct{}{}
+		err = q.sendTo(m, from)
+	} else {
+		q.sentIDs[m.Id] = struct{}{}
+		err = q.send(m)
+	}
+	if err != nil {
+		q.sendError(fmt.Errorf("Failed to query instance %s: %v", inp.Name, err))
 	}
+}
 
-	// Map the in-progress responses
-	inprogress := make(map[string]*ServiceEntry)
+// logf is used to log through the query's Logger, if set
+func (q *queryState) logf(format string, args ...interface{}) {
+	if q.params.Logger != nil {
+		q.params.Logger.Printf(format, args...)
+		return
+	}
+	logf(format, args...)
+}
 
-	// Listen until we reach the timeout
-	finish := time.After(params.Timeout)
-	for {
+// sendError is used to log and count an error sending a query, and to
+// report it on the Errors channel without blocking
+func (q *queryState) sendError(err error) {
+	q.logf("[ERR] mdns: %v", err)
+	if q.params.Metrics != nil {
+		q.params.Metrics.IncSendErrors()
+	}
+	if q.params.Errors != nil {
 		select {
-		case resp := <-msgCh:
-			var inp *ServiceEntry
-			for _, answer := range resp.Answer {
-				switch rr := answer.(type) {
-				case *dns.PTR:
-					// Create new entry for this
-					inp = ensureName(inprogress, rr.Ptr)
-
-				case *dns.SRV:
-					// Get the port
-					inp = ensureName(inprogress, rr.Target)
-					inp.Port = int(rr.Port)
-
-				case *dns.TXT:
-					// Pull out the txt
-					inp = ensureName(inprogress, rr.Hdr.Name)
-					inp.Info = strings.Join(rr.Txt, "|")
-					inp.hasTXT = true
-
-				case *dns.A:
-					// Pull out the IP
-					inp = ensureName(inprogress, rr.Hdr.Name)
-					inp.Addr = rr.A
-
-				case *dns.AAAA:
-					// Pull out the IP
-					inp = ensureName(inprogress, rr.Hdr.Name)
-					inp.Addr = rr.AAAA
-				}
+		case q.params.Errors <- err:
+		default:
+		}
+	}
+}
+
+// subtypeName is used to extract the subtype from a name of the form
+// "<subtype>._sub.<service>.<domain>."
+func subtypeName(name string) (string, bool) {
+	idx := strings.Index(name, "._sub.")
+	if idx <= 0 {
+		return "", false
+	}
+	return name[:idx], true
+}
+
+// mergeRecord is used to merge a single record into the in-progress
+// entries, returning the entry it applies to. Nil is returned for
+// unhandled records, or if the entry could not be tracked.
+func mergeRecord(inprogress map[string]*ServiceEntry, answer dns.RR, max int) *ServiceEntry {
+	var inp *ServiceEntry
+	switch rr := answer.(type) {
+	case *dns.PTR:
+		// Create new entry for this
+		inp = ensureName(inprogress, rr.Ptr, max)
+
+		// Record the subtype if this is a subtype pointer
+		if sub, ok := subtypeName(rr.Hdr.Name); ok && inp != nil {
+			inp.addSubtype(sub)
+		}
+
+		// A zero TTL is a goodbye, meaning the instance is going away,
+		// until it is announced again
+		if inp != nil {
+			inp.goodbye = rr.Hdr.Ttl == 0
+		}
+		return inp
+
+	case *dns.SRV:
+		// Ensure the target can be used as a query name
+		target, ok := normalizeName(rr.Target)
+		if !ok {
+			logf("[WARN] mdns: Ignoring SRV record for %s with malformed target %q",
+				rr.Hdr.Name, rr.Target)
+			return nil
+		}
+
+		// Get the port
+		if inp = ensureName(inprogress, target, max); inp != nil {
+			inp.target = target
+			inp.Port = int(rr.Port)
+			if rr.Hdr.Ttl != 0 {
+				inp.goodbye = false
 			}
+			inp.Priority = rr.Priority
+			inp.Weight = rr.Weight
+		}
 
-			// Check if this entry is complete
-			if inp.complete() && !inp.sent {
-				inp.sent = true
-				select {
-				case params.Entries <- inp:
-				default:
-				}
-			} else {
-				// Fire off a node specific query
-				m := new(dns.Msg)
-				m.SetQuestion(inp.Name, dns.TypeANY)
-				if err := c.sendQuery(m); err != nil {
-					log.Printf("[ERR] mdns: Failed to query instance %s: %v", inp.Name, err)
-				}
+	case *dns.TXT:
+		// Pull out the txt
+		if inp = ensureName(inprogress, rr.Hdr.Name, max); inp != nil {
+			info := strings.Join(rr.Txt, "|")
+			if inp.sent && info != strings.Join(inp.InfoFields, "|") {
+				inp.txtUpdated = true
+				inp.ChangedKeys = txtDiff(inp.InfoFields, rr.Txt)
+			}
+			inp.Info = info
+			inp.InfoFields = rr.Txt
+			inp.InvalidTXT = !validUTF8(rr.Txt)
+			inp.hasTXT = true
+		}
+
+	case *dns.A:
+		// Pull out the IP
+		if inp = ensureName(inprogress, rr.Hdr.Name, max); inp != nil {
+			inp.AddrV4 = rr.A
+			if inp.Addr == nil {
+				inp.Addr = rr.A
+			}
+		}
+
+	case *dns.AAAA:
+		// Pull out the IP
+		if inp = ensureName(inprogress, rr.Hdr.Name, max); inp != nil {
+			inp.AddrV6 = rr.AAAA
+			if inp.Addr == nil {
+				inp.Addr = rr.AAAA
 			}
-		case <-finish:
-			return nil
 		}
 	}
-	return nil
+	if inp != nil {
+		inp.observeTTL(answer.Header().Ttl)
+	}
+	return inp
+}
+
+// validUTF8 is used to check that every TXT string is valid UTF-8
+func validUTF8(txt []string) bool {
+	for _, s := range txt {
+		if !utf8.ValidString(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// txtDiff is used to list the keys whose presence or value differs
+// between two TXT records, in sorted order. As described by RFC 6763,
+// keys are compared case insensitively and only the first occurrence
+// of a key counts.
+func txtDiff(prev, next []string) []string {
+	before, after := txtKeys(prev), txtKeys(next)
+	var changed []string
+	for key, value := range before {
+		if v, ok := after[key]; !ok || v != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// txtKeys is used to map the keys of a TXT record to their values
+func txtKeys(txt []string) map[string]string {
+	keys := make(map[string]string)
+	for _, s := range txt {
+		key := s
+		if idx := strings.Index(s, "="); idx >= 0 {
+			key = s[:idx]
+		}
+		key = strings.ToLower(key)
+		if _, ok := keys[key]; key != "" && !ok {
+			keys[key] = s
+		}
+	}
+	return keys
+}
+
+// normalizeName is used to validate a domain name, adding the trailing
+// dot if missing. False is returned if the name is malformed.
+func normalizeName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return "", false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return "", false
+		}
+	}
+	return name + ".", true
+}
+
+// appendEntry is used to append an entry to a list if not already present
+func appendEntry(list []*ServiceEntry, inp *ServiceEntry) []*ServiceEntry {
+	for _, e := range list {
+		if e == inp {
+			return list
+		}
+	}
+	return append(list, inp)
 }
 
 // sendQuery is used to multicast a query out
-func (c *client) sendQuery(q *dns.Msg) error {
+func (c *Client) sendQuery(q *dns.Msg) error {
+	return c.sendQueryOn(q, c.ipv4List, c.ipv6List)
+}
+
+// sendQueryOn is used to multicast a query using the given sockets,
+// either of which may be nil. If the query is sent over one family but
+// fails on the other, the failure is only logged.
+func (c *Client) sendQueryOn(q *dns.Msg, ipv4, ipv6 *net.UDPConn) error {
+	return newMulticaster(ipv4, ipv6).send(q)
+}
+
+// packetWriter is the part of a socket used to send queries
+type packetWriter interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+}
+
+// multicaster is used to send the queries of a single query over a pair
+// of sockets, either of which may be nil. Hosts without IPv6 routing can
+// still bind an IPv6 socket, so once a send finds there is no route,
+// IPv6 is skipped for the rest of the query.
+type multicaster struct {
+	ipv4 packetWriter
+	ipv6 packetWriter
+
+	// parallel if set writes to both families concurrently
+	parallel bool
+
+	// onUnreachable if set is called once IPv6 is skipped
+	onUnreachable func(error)
+
+	// logf is used to log send failures
+	logf func(format string, args ...interface{})
+}
+
+// newMulticaster is used to create a multicaster for the given sockets
+func newMulticaster(ipv4, ipv6 *net.UDPConn) *multicaster {
+	m := &multicaster{logf: logf}
+	if ipv4 != nil {
+		m.ipv4 = ipv4
+	}
+	if ipv6 != nil {
+		m.ipv6 = ipv6
+	}
+	return m
+}
+
+// send is used to multicast a query over both families
+func (m *multicaster) send(q *dns.Msg) error {
+	return m.sendOn(q, true, true)
+}
+
+// sendV4 is used to multicast a query over IPv4 only
+func (m *multicaster) sendV4(q *dns.Msg) error {
+	return m.sendOn(q, true, false)
+}
+
+// sendV6 is used to multicast a query over IPv6 only
+func (m *multicaster) sendV6(q *dns.Msg) error {
+	return m.sendOn(q, false, true)
+}
+
+// sendOn is used to multicast a query over the selected families,
+// returning an error only if it was sent over none of them
+func (m *multicaster) sendOn(q *dns.Msg, v4, v6 bool) error {
 	buf, err := q.Pack()
 	if err != nil {
 		return err
 	}
-	if c.ipv4List != nil {
-		c.ipv4List.WriteTo(buf, ipv4Addr)
+	v4 = v4 && m.ipv4 != nil
+	v6 = v6 && m.ipv6 != nil
+	var err4, err6 error
+	if v4 && v6 && m.parallel {
+		done := make(chan struct{})
+		go func() {
+			err4 = m.writeV4(buf)
+			close(done)
+		}()
+		err6 = m.writeV6(buf)
+		<-done
+	} else {
+		if v4 {
+			err4 = m.writeV4(buf)
+		}
+		if v6 {
+			err6 = m.writeV6(buf)
+		}
 	}
-	if c.ipv6List != nil {
-		c.ipv6List.WriteTo(buf, ipv6Addr)
+	if (v4 && err4 == nil) || (v6 && err6 == nil) {
+		return nil
+	}
+	var errs []string
+	if err4 != nil {
+		errs = append(errs, fmt.Sprintf("IPv4: %v", err4))
+	}
+	if err6 != nil {
+		errs = append(errs, fmt.Sprintf("IPv6: %v", err6))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to send query: %s", strings.Join(errs, ", "))
 	}
 	return nil
 }
 
+// writeV4 is used to write a packed query to the IPv4 socket
+func (m *multicaster) writeV4(buf []byte) error {
+	_, err := m.ipv4.WriteTo(buf, ipv4Addr)
+	if err != nil {
+		m.logf("[ERR] mdns: Failed to send query over IPv4: %v", err)
+	}
+	return err
+}
+
+// writeV6 is used to write a packed query to the IPv6 socket, skipping
+// IPv6 from then on if there is no route
+func (m *multicaster) writeV6(buf []byte) error {
+	_, err := m.ipv6.WriteTo(buf, ipv6Addr)
+	if err == nil {
+		return nil
+	}
+	if unreachable(err) {
+		m.ipv6 = nil
+		report := fmt.Errorf("No IPv6 route, skipping IPv6 for the query: %v", err)
+		if m.onUnreachable != nil {
+			m.onUnreachable(report)
+		} else {
+			m.logf("[WARN] mdns: %v", report)
+		}
+	} else {
+		m.logf("[ERR] mdns: Failed to send query over IPv6: %v", err)
+	}
+	return err
+}
+
+// unreachable is used to check if a send failed for lack of a route
+func unreachable(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ENETUNREACH
+}
+
+// sendQueryTo is used to unicast a query to the given address
+func (c *Client) sendQueryTo(q *dns.Msg, addr net.Addr) error {
+	buf, err := q.Pack()
+	if err != nil {
+		return err
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("Unsupported address %v", addr)
+	}
+	conn := c.ipv6List
+	if udpAddr.IP.To4() != nil {
+		conn = c.ipv4List
+	}
+	if conn == nil {
+		return fmt.Errorf("No socket for address family of %v", addr)
+	}
+	_, err = conn.WriteToUDP(buf, udpAddr)
+	return err
+}
+
+// recvBufPool holds receive buffers, so they are reused when sockets are
+// rebound or clients are recreated
+var recvBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 65536)
+	},
+}
+
+// startRecv is used to start a tracked receive goroutine for a socket
+func (c *Client) startRecv(l *net.UDPConn) {
+	if l == nil {
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.recv(l, c.msgCh)
+	}()
+}
+
 // recv is used to receive until we get a shutdown
-func (c *client) recv(l *net.UDPConn, msgCh chan *dns.Msg) {
+func (c *Client) recv(l *net.UDPConn, msgCh chan *msgAddr) {
 	if l == nil {
 		return
 	}
-	buf := make([]byte, 65536)
-	for !c.closed {
-		n, err := l.Read(buf)
+	buf := recvBufPool.Get().([]byte)
+	defer recvBufPool.Put(buf)
+	for {
+		n, src, err := l.ReadFromUDP(buf)
 		if err != nil {
+			// Stop once the socket is closed or replaced
+			if !c.active(l) {
+				return
+			}
 			continue
 		}
+		// A truncated response still carries the records that fit
 		msg := new(dns.Msg)
-		if err := msg.Unpack(buf[:n]); err != nil {
-			log.Printf("[ERR] mdns: Failed to unpack packet: %v", err)
+		if err := msg.Unpack(buf[:n]); err != nil && err != dns.ErrTruncated {
+			logf("[ERR] mdns: Failed to unpack packet: %v", err)
 			continue
 		}
 		select {
-		case msgCh <- msg:
+		case msgCh <- &msgAddr{msg, src}:
 		case <-c.closedCh:
 			return
 		}
 	}
 }
 
-// ensureName is used to ensure the named node is in progress
-func ensureName(inprogress map[string]*ServiceEntry, name string) *ServiceEntry {
-	if inp, ok := inprogress[name]; ok {
+// ensureName is used to ensure the named node is in progress. Names
+// differing only in case or a trailing dot refer to the same node, which
+// keeps the name as first seen. If max is non-zero and that many names
+// are already tracked, nil is returned.
+func ensureName(inprogress map[string]*ServiceEntry, name string, max int) *ServiceEntry {
+	key := nameKey(name)
+	if inp, ok := inprogress[key]; ok {
 		return inp
 	}
+	if max > 0 && len(inprogress) >= max {
+		return nil
+	}
 	inp := &ServiceEntry{
-		Name: name,
+		Name:     name,
+		FQDN:     name,
+		Protocol: protocolName(name),
+	}
+	inprogress[key] = inp
+	if max > 0 && len(inprogress) == max {
+		logf("[WARN] mdns: Tracking limit of %d instances reached, ignoring new names", max)
 	}
-	inprogress[name] = inp
 	return inp
 }
+
+// nameKey is used to normalize a name to lower case with a single
+// trailing dot, as DNS names compare case insensitively
+func nameKey(name string) string {
+	return strings.ToLower(strings.TrimRight(name, ".")) + "."
+}
@@ -0,0 +1,2948 @@
+package mdns
+
+import (
+	"bytes"
+	"code.google.com/p/go.net/context"
+	"code.google.com/p/go.net/ipv4"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// discardQuery is a sendFunc that drops all queries
+func discardQuery(q *dns.Msg) error {
+	return nil
+}
+
+func TestClient_HandleResponse_SplitPackets(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	if len(recs) != 4 {
+		t.Fatalf("bad: %v", recs)
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{Entries: entries}
+	state := newQueryState(params, discardQuery)
+
+	// Deliver the PTR, then SRV and A, then TXT in separate packets
+	packets := [][]dns.RR{recs[:1], recs[1:3], recs[3:]}
+	for i, answers := range packets {
+		state.handleResponse(&dns.Msg{Answer: answers}, nil)
+		if i < len(packets)-1 && len(entries) != 0 {
+			t.Fatalf("premature entry after packet %d", i)
+		}
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	e := <-entries
+	if e.Name != s.instanceAddr {
+		t.Fatalf("bad: %v", e)
+	}
+	if e.Port != s.Port {
+		t.Fatalf("bad: %v", e)
+	}
+	if e.Info != s.Info {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestClient_HandleResponse_AllSections(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, func(q *dns.Msg) error {
+		t.Fatalf("unexpected follow up query: %v", q)
+		return nil
+	})
+
+	// Only the PTR is an answer, the rest is spread over the other sections
+	state.handleResponse(&dns.Msg{
+		Answer: recs[:1],
+		Ns:     recs[1:2],
+		Extra:  recs[2:],
+	}, nil)
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	e := <-entries
+	if e.Port != s.Port || e.Info != s.Info || e.AddrV4 == nil {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestClient_HandleResponse_NormalizeNames(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	// The PTR names the instance in another case, and the other
+	// records leave off the trailing dot
+	recs[0].(*dns.PTR).Ptr = "HostName._http._tcp.local."
+	for _, rr := range recs[1:] {
+		rr.Header().Name = "hostname._http._tcp.local"
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	if len(state.inprogress) != 1 {
+		t.Fatalf("bad: %v", state.inprogress)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; e.Name != "HostName._http._tcp.local." {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestClient_Stats(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	nsec := &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   s.instanceAddr,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+		},
+	}
+	opt := &dns.OPT{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeOPT,
+		},
+	}
+
+	c := &Client{}
+	if stats := c.Stats(); len(stats.RecordTypes) != 0 {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	state := newQueryState(&QueryParam{Entries: make(chan *ServiceEntry, 4)}, discardQuery)
+	state.handleResponse(&dns.Msg{
+		Answer: recs[:1],
+		Extra:  append(recs[1:], nsec, opt),
+	}, nil)
+	state.handleResponse(&dns.Msg{Answer: recs[:1]}, nil)
+	c.lastQuery = state
+
+	expect := map[uint16]int{
+		dns.TypePTR:  2,
+		dns.TypeSRV:  1,
+		dns.TypeA:    1,
+		dns.TypeTXT:  1,
+		dns.TypeNSEC: 1,
+		dns.TypeOPT:  1,
+	}
+	if stats := c.Stats(); !reflect.DeepEqual(stats.RecordTypes, expect) {
+		t.Fatalf("bad: %v", stats.RecordTypes)
+	}
+}
+
+func TestClient_HandleResponse_MultipleInstances(t *testing.T) {
+	// A single response carries the records of every instance
+	var answers []dns.RR
+	for _, instance := range []string{"one", "two", "three"} {
+		s := makeService(t)
+		s.Instance = instance
+		s.Init()
+		answers = append(answers, s.Records(dns.Question{
+			Name:  "_http._tcp.local.",
+			Qtype: dns.TypePTR,
+		})...)
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: answers}, nil)
+	if len(entries) != 3 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	names := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		names[(<-entries).Name] = true
+	}
+	for _, instance := range []string{"one", "two", "three"} {
+		if !names[instance+"._http._tcp.local."] {
+			t.Fatalf("bad: %v", names)
+		}
+	}
+}
+
+func TestClient_HandleResponse_MaxTrackedInstances(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{Entries: entries, MaxTrackedInstances: 10}
+	state := newQueryState(params, discardQuery)
+
+	// Start tracking the legitimate instance
+	state.handleResponse(&dns.Msg{Answer: recs[:1]}, nil)
+
+	// Flood with unique names
+	for i := 0; i < 1000; i++ {
+		ptr := &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   "_http._tcp.local.",
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+			},
+			Ptr: fmt.Sprintf("flood%d._http._tcp.local.", i),
+		}
+		state.handleResponse(&dns.Msg{Answer: []dns.RR{ptr}}, nil)
+	}
+	if len(state.inprogress) != params.MaxTrackedInstances {
+		t.Fatalf("bad: %d", len(state.inprogress))
+	}
+
+	// Complete the legitimate instance
+	state.handleResponse(&dns.Msg{Answer: recs[1:]}, nil)
+	if len(state.inprogress) != params.MaxTrackedInstances {
+		t.Fatalf("bad: %d", len(state.inprogress))
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; e.Name != s.instanceAddr {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestClient_HandleResponse_Subtypes(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	// Advertise the instance under a subtype as well
+	sub := &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   "_printer._sub._http._tcp.local.",
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+		},
+		Ptr: s.instanceAddr,
+	}
+	answers := append([]dns.RR{sub, sub}, recs...)
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{Entries: entries}
+	state := newQueryState(params, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: answers}, nil)
+
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	e := <-entries
+	if !reflect.DeepEqual(e.Subtypes, []string{"_printer"}) {
+		t.Fatalf("bad: %v", e.Subtypes)
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	sorted := []*ServiceEntry{
+		&ServiceEntry{Name: "a.local.", Port: 80},
+		&ServiceEntry{Name: "a.local.", Addr: net.IPv4(10, 0, 0, 1), Port: 80},
+		&ServiceEntry{Name: "a.local.", Addr: net.IPv4(10, 0, 0, 2), Port: 80},
+		&ServiceEntry{Name: "a.local.", Addr: net.IPv4(10, 0, 0, 2), Port: 8080},
+		&ServiceEntry{Name: "b.local.", Addr: net.IPv4(10, 0, 0, 1), Port: 80},
+		&ServiceEntry{Name: "c.local.", Addr: net.ParseIP("::1"), Port: 80},
+	}
+	shuffled := []*ServiceEntry{
+		sorted[3], sorted[5], sorted[0], sorted[4], sorted[2], sorted[1],
+	}
+	SortEntries(shuffled)
+	if !reflect.DeepEqual(shuffled, sorted) {
+		t.Fatalf("bad: %v", shuffled)
+	}
+}
+
+func TestMergeEntries(t *testing.T) {
+	now := time.Now()
+	first := []*ServiceEntry{
+		&ServiceEntry{Name: "a.local.", Addr: net.IPv4(10, 0, 0, 1), Port: 80,
+			Info: "old", Subtypes: []string{"_printer"}, LastSeen: now.Add(-time.Minute)},
+		&ServiceEntry{Name: "b.local.", Addr: net.IPv4(10, 0, 0, 2), Port: 22, LastSeen: now},
+	}
+	second := []*ServiceEntry{
+		&ServiceEntry{Name: "a.local.", Port: 8080, Info: "new",
+			Subtypes: []string{"_scanner"}, LastSeen: now},
+		&ServiceEntry{Name: "c.local.", Addr: net.IPv4(10, 0, 0, 3), Port: 443, LastSeen: now},
+	}
+
+	// Merging is independent of the order of the sets
+	for _, merged := range [][]*ServiceEntry{
+		MergeEntries(first, second),
+		MergeEntries(second, first),
+	} {
+		if len(merged) != 3 {
+			t.Fatalf("bad: %v", merged)
+		}
+		a := merged[0]
+		if a.Name != "a.local." || !a.Addr.Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Fatalf("bad: %v", a)
+		}
+		if a.Port != 8080 || a.Info != "new" || !a.LastSeen.Equal(now) {
+			t.Fatalf("bad: %v", a)
+		}
+		if !reflect.DeepEqual(a.Subtypes, []string{"_printer", "_scanner"}) {
+			t.Fatalf("bad: %v", a.Subtypes)
+		}
+		if merged[1].Name != "b.local." || merged[2].Name != "c.local." {
+			t.Fatalf("bad: %v", merged)
+		}
+	}
+
+	// The inputs are left untouched
+	if first[0].Port != 80 || len(first[0].Subtypes) != 1 {
+		t.Fatalf("bad: %v", first[0])
+	}
+}
+
+func TestMergeEntries_AddressFamilies(t *testing.T) {
+	now := time.Now()
+	v4 := []*ServiceEntry{
+		&ServiceEntry{Name: "a.local.", Addr: net.IPv4(10, 0, 0, 1),
+			AddrV4: net.IPv4(10, 0, 0, 1), Port: 80, LastSeen: now.Add(-time.Minute)},
+	}
+	v6 := []*ServiceEntry{
+		&ServiceEntry{Name: "a.local.", Addr: net.ParseIP("fd00::1"),
+			AddrV6: net.ParseIP("fd00::1"), Port: 80, LastSeen: now},
+	}
+
+	// The addresses of both families are kept, whichever is fresher
+	for _, merged := range [][]*ServiceEntry{
+		MergeEntries(v4, v6),
+		MergeEntries(v6, v4),
+	} {
+		if len(merged) != 1 {
+			t.Fatalf("bad: %v", merged)
+		}
+		a := merged[0]
+		if !a.AddrV4.Equal(net.IPv4(10, 0, 0, 1)) || !a.AddrV6.Equal(net.ParseIP("fd00::1")) {
+			t.Fatalf("bad: %v", a)
+		}
+	}
+
+	// Entries from before AddrV4 and AddrV6 only set Addr
+	legacy := []*ServiceEntry{
+		&ServiceEntry{Name: "a.local.", Addr: net.IPv4(10, 0, 0, 2), Port: 80, LastSeen: now},
+	}
+	a := MergeEntries(v6, legacy)[0]
+	if !a.AddrV4.Equal(net.IPv4(10, 0, 0, 2)) || !a.AddrV6.Equal(net.ParseIP("fd00::1")) {
+		t.Fatalf("bad: %v", a)
+	}
+}
+
+// countingZone wraps a Zone, counting the questions asked of it
+type countingZone struct {
+	Zone
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func (c *countingZone) Records(q dns.Question) []dns.RR {
+	c.lock.Lock()
+	c.counts[q.Name]++
+	c.lock.Unlock()
+	return c.Zone.Records(q)
+}
+
+func (c *countingZone) count(name string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.counts[name]
+}
+
+func TestClient_ReQueryOnFirstResponse(t *testing.T) {
+	s := makeService(t)
+	s.Service = "_requery._tcp"
+	s.Init()
+	zone := &countingZone{Zone: s, counts: make(map[string]int)}
+	serv, err := NewServer(&Config{Zone: zone})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	// Query once without reissuing, to learn how many times each
+	// query is seen (once per address family)
+	params := &QueryParam{
+		Service: "_requery._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: make(chan *ServiceEntry, 4),
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	base := zone.count("_requery._tcp.local.")
+	if base == 0 {
+		t.Fatalf("query not seen")
+	}
+
+	params.ReQueryOnFirstResponse = true
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := zone.count("_requery._tcp.local.") - base; n <= base {
+		t.Fatalf("bad: %d %d", base, n)
+	}
+}
+
+// memoryResponder answers queries from a zone without any sockets. It
+// returns the channel responses are delivered on, the function used to
+// send queries, and a function to stop the responder.
+func memoryResponder(zone Zone) (chan *msgAddr, sendFunc, func()) {
+	queryCh := make(chan *dns.Msg, 32)
+	msgCh := make(chan *msgAddr, 32)
+	send := func(q *dns.Msg) error {
+		queryCh <- q
+		return nil
+	}
+
+	stopCh := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case q := <-queryCh:
+				var resp dns.Msg
+				resp.SetReply(q)
+				for _, question := range q.Question {
+					resp.Answer = append(resp.Answer, zone.Records(question)...)
+				}
+				select {
+				case msgCh <- &msgAddr{msg: &resp}:
+				case <-stopCh:
+					return
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return msgCh, send, func() { close(stopCh) }
+}
+
+func TestRunQuery_InMemory(t *testing.T) {
+	s := makeService(t)
+	msgCh, send, stop := memoryResponder(s)
+	defer stop()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_http._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; e.Name != s.instanceAddr {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestRunQuery_VerbatimName(t *testing.T) {
+	s := makeService(t)
+	msgCh, send, stop := memoryResponder(s)
+	defer stop()
+
+	// Ask for the instance SRV directly, ignoring Service and Domain
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_ignored._tcp",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := runQuery("hostname._http._tcp.local.", dns.TypeSRV, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	e := <-entries
+	if e.Name != s.instanceAddr || e.Port != s.Port || e.Info != s.Info {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestQuery_NoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 3; i++ {
+		params := &QueryParam{
+			Service: "_leak._tcp",
+			Domain:  "local",
+			Timeout: 10 * time.Millisecond,
+			Entries: make(chan *ServiceEntry, 4),
+		}
+		if err := Query(params); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Goroutines of unrelated tests may still be winding down, so allow
+	// them a moment, but the queries must not leave any behind
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %d %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_Rebind(t *testing.T) {
+	s := makeService(t)
+	s.Service = "_rebind._tcp"
+	s.Init()
+	serv, err := NewServer(&Config{Zone: s})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	c, err := NewClient()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+	port := func() int {
+		return c.ipv4List.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	first := port()
+	if err := c.Rebind(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	second := port()
+	if first == second {
+		t.Fatalf("port not changed: %d", first)
+	}
+
+	// Rebind before every query, and ensure discovery still works
+	c.RebindInterval = time.Nanosecond
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service: "_rebind._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if port() == second {
+		t.Fatalf("port not changed: %d", second)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+}
+
+func TestServiceEntry_RecordsRoundTrip(t *testing.T) {
+	for _, addr := range []net.IP{net.IPv4(127, 0, 0, 1), net.ParseIP("fe80::1")} {
+		e := &ServiceEntry{
+			Name:     "hostname._http._tcp.local.",
+			Addr:     addr,
+			Port:     80,
+			Info:     "Local web server",
+			Subtypes: []string{"_printer"},
+		}
+		recs := e.ToRecords(120)
+		if len(recs) != 5 {
+			t.Fatalf("bad: %v", recs)
+		}
+		if recs[0].(*dns.PTR).Hdr.Name != "_http._tcp.local." {
+			t.Fatalf("bad: %v", recs[0])
+		}
+		for _, rr := range recs {
+			if rr.Header().Ttl != 120 {
+				t.Fatalf("bad: %v", rr)
+			}
+		}
+
+		out := FromRecords(recs)
+		if out == nil {
+			t.Fatalf("no entry")
+		}
+		if out.Name != e.Name || out.Port != e.Port || out.Info != e.Info {
+			t.Fatalf("bad: %v", out)
+		}
+		if !out.Addr.Equal(e.Addr) {
+			t.Fatalf("bad: %v", out.Addr)
+		}
+		if !reflect.DeepEqual(out.Subtypes, e.Subtypes) {
+			t.Fatalf("bad: %v", out.Subtypes)
+		}
+		if !out.complete() {
+			t.Fatalf("incomplete: %v", out)
+		}
+	}
+
+	if FromRecords(nil) != nil {
+		t.Fatalf("expected nil")
+	}
+}
+
+func TestClient_HandleResponse_MalformedSRV(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	// Add SRV records with bad targets, plus one missing the trailing dot
+	var answers []dns.RR
+	for _, target := range []string{"", ".", "bad..name.", "other._http._tcp.local"} {
+		answers = append(answers, &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   "other._http._tcp.local.",
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+			},
+			Port:   8080,
+			Target: target,
+		})
+	}
+	answers = append(answers, recs...)
+
+	// Ensure the follow up queries can be packed
+	send := func(q *dns.Msg) error {
+		_, err := q.Pack()
+		return err
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{Entries: entries}
+	state := newQueryState(params, send)
+	state.handleResponse(&dns.Msg{Answer: answers}, nil)
+
+	if len(state.inprogress) != 2 {
+		t.Fatalf("bad: %v", state.inprogress)
+	}
+	if inp, ok := state.inprogress["other._http._tcp.local."]; !ok || inp.Port != 8080 {
+		t.Fatalf("bad: %v", state.inprogress)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; e.Name != s.instanceAddr {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestRunQuery_RestrictSource(t *testing.T) {
+	restricted := &net.UDPAddr{IP: net.ParseIP("192.168.1.50"), Port: 5353}
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.1.51"), Port: 5353}
+
+	// Queue a complete answer from each source
+	msgCh := make(chan *msgAddr, 2)
+	sources := map[string]*net.UDPAddr{"other": other, "restricted": restricted}
+	for instance, src := range sources {
+		s := makeService(t)
+		s.Instance = instance
+		s.Init()
+		recs := s.Records(dns.Question{
+			Name:  "_http._tcp.local.",
+			Qtype: dns.TypePTR,
+		})
+		msgCh <- &msgAddr{msg: &dns.Msg{Answer: recs}, src: src}
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Service:        "_http._tcp",
+		Domain:         "local",
+		Timeout:        20 * time.Millisecond,
+		Entries:        entries,
+		RestrictSource: restricted.IP,
+	}
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, discardQuery), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; e.Name != "restricted._http._tcp.local." {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestClient_HandleResponse_TXTUpdate(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	queries := 0
+	send := func(q *dns.Msg) error {
+		queries++
+		return nil
+	}
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{Entries: entries}
+	state := newQueryState(params, send)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	<-entries
+
+	// A repeated TXT is not an update
+	state.handleResponse(&dns.Msg{Answer: recs[3:]}, nil)
+	if len(entries) != 0 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+
+	// Update only the TXT
+	s.Info = "Updated web server"
+	txt := s.Records(dns.Question{
+		Name:  s.instanceAddr,
+		Qtype: dns.TypeTXT,
+	})
+	state.handleResponse(&dns.Msg{Answer: txt}, nil)
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; e.Info != "Updated web server" {
+		t.Fatalf("bad: %v", e)
+	}
+	if queries != 0 {
+		t.Fatalf("unexpected queries: %d", queries)
+	}
+}
+
+func TestClient_UserData(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	c := &Client{cache: newEntryCache()}
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.observe = c.cache.update
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	if e := <-entries; e.UserData != nil {
+		t.Fatalf("bad: %v", e)
+	}
+
+	if c.SetUserData("missing._http._tcp.local.", "row") {
+		t.Fatalf("expected unknown instance")
+	}
+	if !c.SetUserData(s.instanceAddr, "row") {
+		t.Fatalf("expected known instance")
+	}
+
+	// A later revision of the instance carries the user data
+	s.Info = "Updated web server"
+	txt := s.Records(dns.Question{
+		Name:  s.instanceAddr,
+		Qtype: dns.TypeTXT,
+	})
+	state.handleResponse(&dns.Msg{Answer: txt}, nil)
+	e := <-entries
+	if e.Info != "Updated web server" || e.UserData != "row" {
+		t.Fatalf("bad: %v", e)
+	}
+	if out := c.Entries(); len(out) != 1 || out[0].UserData != "row" {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestClient_HandleResponse_ResultFamily(t *testing.T) {
+	s := makeService(t)
+	s.Addr = net.ParseIP("fe80::1")
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	for _, family := range []AddressFamily{AnyFamily, IPv4Family, IPv6Family} {
+		entries := make(chan *ServiceEntry, 4)
+		params := &QueryParam{Entries: entries, ResultFamily: family}
+		state := newQueryState(params, discardQuery)
+		state.handleResponse(&dns.Msg{Answer: recs}, nil)
+
+		// The IPv6 only service is not emitted when IPv4 is wanted
+		if expect := family != IPv4Family; (len(entries) == 1) != expect {
+			t.Fatalf("bad: %v %d", family, len(entries))
+		}
+		if family != IPv4Family {
+			continue
+		}
+
+		// Until it gains an IPv4 address
+		a := &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   s.instanceAddr,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    120,
+			},
+			A: net.IPv4(127, 0, 0, 1).To4(),
+		}
+		state.handleResponse(&dns.Msg{Answer: []dns.RR{a}}, nil)
+		if len(entries) != 1 {
+			t.Fatalf("bad: %d", len(entries))
+		}
+	}
+}
+
+func TestClient_HandleResponse_InfoFields(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	fields := []string{"path=/api", "sep=a|b", "eq=x=y", "flag", "path=/ignored"}
+	for i, rr := range recs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			recs[i] = &dns.TXT{Hdr: txt.Hdr, Txt: fields}
+		}
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	e := <-entries
+	if !reflect.DeepEqual(e.InfoFields, fields) {
+		t.Fatalf("bad: %v", e.InfoFields)
+	}
+	if e.Info != strings.Join(fields, "|") {
+		t.Fatalf("bad: %v", e.Info)
+	}
+	expect := map[string]string{
+		"path": "/api",
+		"sep":  "a|b",
+		"eq":   "x=y",
+		"flag": "",
+	}
+	if m := e.TXTMap(); !reflect.DeepEqual(m, expect) {
+		t.Fatalf("bad: %v", m)
+	}
+}
+
+func TestClient_HandleResponse_InfoSeparator(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	fields := []string{"path=/api", "sep=a|b"}
+	for i, rr := range recs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			recs[i] = &dns.TXT{Hdr: txt.Hdr, Txt: fields}
+		}
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{Entries: entries, InfoSeparator: "\n"}
+	c := &Client{cache: newEntryCache()}
+	state := newQueryState(params, discardQuery)
+	state.observe = c.cache.update
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	e := <-entries
+	if e.Info != "path=/api\nsep=a|b" {
+		t.Fatalf("bad: %q", e.Info)
+	}
+	if !reflect.DeepEqual(e.InfoFields, fields) {
+		t.Fatalf("bad: %v", e.InfoFields)
+	}
+
+	// The entries kept by the client agree
+	if out := c.Entries(); len(out) != 1 || out[0].Info != e.Info {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Receiving the same TXT again is not an update
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	if len(entries) != 0 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+}
+
+func TestClient_HandleResponse_InvalidTXT(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	fields := []string{"name=ok", "bad=\xff\xfe"}
+	for i, rr := range recs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			recs[i] = &dns.TXT{Hdr: txt.Hdr, Txt: fields}
+		}
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	e := <-entries
+	if !e.InvalidTXT {
+		t.Fatalf("bad: %v", e)
+	}
+	if !bytes.Equal([]byte(e.InfoFields[1]), []byte{'b', 'a', 'd', '=', 0xff, 0xfe}) {
+		t.Fatalf("bad: %q", e.InfoFields)
+	}
+
+	// A valid revision clears the flag
+	s.Info = "name=ok"
+	txt := s.Records(dns.Question{
+		Name:  s.instanceAddr,
+		Qtype: dns.TypeTXT,
+	})
+	state.handleResponse(&dns.Msg{Answer: txt}, nil)
+	if e := <-entries; e.InvalidTXT {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestClient_HandleResponse_DualStack(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	aaaa := &dns.AAAA{
+		Hdr: dns.RR_Header{
+			Name:   s.instanceAddr,
+			Rrtype: dns.TypeAAAA,
+			Class:  dns.ClassINET,
+			Ttl:    120,
+		},
+		AAAA: net.ParseIP("fe80::1"),
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: append(recs, aaaa)}, nil)
+	e := <-entries
+	if !e.AddrV4.Equal(net.IPv4(127, 0, 0, 1)) || !e.AddrV6.Equal(aaaa.AAAA) {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// Addr is the first address seen
+	if !e.Addr.Equal(e.AddrV4) {
+		t.Fatalf("bad: %v", e.Addr)
+	}
+
+	// Either address completes an entry
+	v6only := &ServiceEntry{AddrV6: aaaa.AAAA, Port: 80, hasTXT: true}
+	if !v6only.complete() {
+		t.Fatalf("expected complete")
+	}
+}
+
+func TestClient_HandleResponse_AddrZone(t *testing.T) {
+	s := makeService(t)
+	s.Addr = net.ParseIP("fe80::1")
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	from := &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: 5353, Zone: "eth0"}
+	state.handleResponse(&dns.Msg{Answer: recs}, from)
+	e := <-entries
+	if e.AddrZone != "eth0" {
+		t.Fatalf("bad: %v", e.AddrZone)
+	}
+	if addr := e.DialAddr(); addr != "[fe80::1%eth0]:80" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	// Global addresses have no zone, and IPv4 is preferred
+	if z := state.zone(net.ParseIP("2001:db8::1"), from); z != "" {
+		t.Fatalf("bad: %v", z)
+	}
+	e.AddrV4 = net.IPv4(192, 168, 1, 2)
+	if addr := e.DialAddr(); addr != "192.168.1.2:80" {
+		t.Fatalf("bad: %v", addr)
+	}
+	if addr := (&ServiceEntry{Port: 80}).DialAddr(); addr != "" {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestClient_HandleResponse_TTL(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	// The PTR's TTL does not describe the instance
+	ttls := map[uint16]uint32{
+		dns.TypePTR: 10,
+		dns.TypeSRV: 120,
+		dns.TypeTXT: 60,
+		dns.TypeA:   30,
+	}
+	for _, rr := range recs {
+		rr.Header().Ttl = ttls[rr.Header().Rrtype]
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	if e := <-entries; e.TTL != 30 {
+		t.Fatalf("bad: %d", e.TTL)
+	}
+}
+
+func TestClient_HandleResponse_GoodbyeReannounce(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	bye := &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   "_http._tcp.local.",
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+		},
+		Ptr: s.instanceAddr,
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	state.handleResponse(&dns.Msg{Answer: []dns.RR{bye}}, nil)
+	if len(entries) != 2 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	<-entries
+	if e := <-entries; e.ExpiresAt.After(time.Now()) {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// The instance comes back within the same query
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; !e.ExpiresAt.After(time.Now()) {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestClient_HandleResponse_AddressChanged(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries, ReportAddressChanges: true}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	if e := <-entries; e.AddressChanged || e.PreviousAddr != nil {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// The instance is renumbered
+	s.Addr = net.IPv4(192, 168, 1, 2)
+	a := s.Records(dns.Question{
+		Name:  s.instanceAddr,
+		Qtype: dns.TypeA,
+	})
+	state.handleResponse(&dns.Msg{Answer: a}, nil)
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	e := <-entries
+	if !e.AddressChanged || !e.PreviousAddr.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("bad: %v", e)
+	}
+	if !e.AddrV4.Equal(s.Addr) {
+		t.Fatalf("bad: %v", e.AddrV4)
+	}
+
+	// The same address again is not a change
+	state.handleResponse(&dns.Msg{Answer: a}, nil)
+	if len(entries) != 0 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+}
+
+func TestClient_HandleResponse_AddressOrder(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	a := func(ips ...net.IP) *dns.Msg {
+		m := new(dns.Msg)
+		for _, ip := range ips {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   s.instanceAddr,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    120,
+				},
+				A: ip,
+			})
+		}
+		return m
+	}
+	other := net.IPv4(192, 168, 1, 2)
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries, ReportAddressChanges: true}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	<-entries
+
+	// A host with several addresses lists them in another order,
+	// which is not a change
+	state.handleResponse(a(net.IPv4(127, 0, 0, 1), other), nil)
+	state.handleResponse(a(other, net.IPv4(127, 0, 0, 1)), nil)
+	if len(entries) != 0 {
+		t.Fatalf("bad: %v", <-entries)
+	}
+
+	// Dropping the emitted address is
+	state.handleResponse(a(other), nil)
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; !e.AddressChanged || !e.AddrV4.Equal(other) {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestClient_HandleResponse_ChangedKeys(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	txt := func(fields ...string) *dns.Msg {
+		return &dns.Msg{Answer: []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   s.instanceAddr,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    120,
+			},
+			Txt: fields,
+		}}}
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	if e := <-entries; e.ChangedKeys != nil {
+		t.Fatalf("bad: %v", e.ChangedKeys)
+	}
+	state.handleResponse(txt("path=/", "version=1", "secure"), nil)
+	expect := []string{"local web server", "path", "secure", "version"}
+	if e := <-entries; !reflect.DeepEqual(e.ChangedKeys, expect) {
+		t.Fatalf("bad: %v", e.ChangedKeys)
+	}
+
+	// Only the updated key is reported
+	state.handleResponse(txt("path=/", "version=2", "secure"), nil)
+	if e := <-entries; !reflect.DeepEqual(e.ChangedKeys, []string{"version"}) {
+		t.Fatalf("bad: %v", e.ChangedKeys)
+	}
+
+	// As are added and removed keys
+	state.handleResponse(txt("path=/", "version=2", "color"), nil)
+	if e := <-entries; !reflect.DeepEqual(e.ChangedKeys, []string{"color", "secure"}) {
+		t.Fatalf("bad: %v", e.ChangedKeys)
+	}
+}
+
+func TestClient_HandleResponse_DedupKey(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	moved := &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   s.instanceAddr,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+		},
+		A: net.IPv4(127, 0, 0, 2).To4(),
+	}
+
+	cases := []struct {
+		key   func(*ServiceEntry) string
+		count int
+	}{
+		{nil, 1},
+		{func(e *ServiceEntry) string {
+			return fmt.Sprintf("%s/%s", e.Name, e.AddrV4)
+		}, 2},
+	}
+	for _, c := range cases {
+		entries := make(chan *ServiceEntry, 4)
+		params := &QueryParam{Entries: entries, DedupKey: c.key}
+		state := newQueryState(params, discardQuery)
+
+		// The same instance seen at two addresses
+		state.handleResponse(&dns.Msg{Answer: recs}, nil)
+		state.handleResponse(&dns.Msg{Answer: []dns.RR{moved}}, nil)
+		if len(entries) != c.count {
+			t.Fatalf("bad: %d", len(entries))
+		}
+
+		if first := <-entries; !first.AddrV4.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("bad: %v", first)
+		}
+		if c.count == 2 {
+			if second := <-entries; !second.AddrV4.Equal(moved.A) {
+				t.Fatalf("bad: %v", second)
+			}
+		}
+	}
+}
+
+// multiZone serves the records of several zones
+type multiZone []Zone
+
+func (m multiZone) Records(q dns.Question) []dns.RR {
+	var recs []dns.RR
+	for _, z := range m {
+		recs = append(recs, z.Records(q)...)
+	}
+	return recs
+}
+
+func TestQueryParam_Validate(t *testing.T) {
+	entries := make(chan *ServiceEntry)
+	invalid := map[string]*QueryParam{
+		"Service": {Entries: entries},
+		"Entries": {Service: "_http._tcp"},
+		"Timeout": {Service: "_http._tcp", Entries: entries, Timeout: -time.Second},
+	}
+	for field, params := range invalid {
+		err := params.validate()
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Fatalf("bad: %s %v", field, err)
+		}
+
+		// Query rejects them before opening any sockets
+		if err := Query(params); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+
+	params := &QueryParam{Service: "_http._tcp", Entries: entries}
+	if err := params.validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if params.Domain != "local" || params.Timeout != time.Second {
+		t.Fatalf("bad: %v", params)
+	}
+}
+
+func TestLookupAll(t *testing.T) {
+	query := func(params *QueryParam) error {
+		if params.Service != "_http._tcp" || params.Domain != "example" {
+			t.Fatalf("bad: %v", params)
+		}
+		if params.Timeout != 50*time.Millisecond {
+			t.Fatalf("bad: %v", params.Timeout)
+		}
+		params.Entries <- &ServiceEntry{Name: "b._http._tcp.example."}
+		params.Entries <- &ServiceEntry{Name: "a._http._tcp.example.", Info: "old"}
+		params.Entries <- &ServiceEntry{Name: "a._http._tcp.example.", Info: "new"}
+		return nil
+	}
+
+	// The instances are sorted, whatever order they arrive in
+	entries, err := lookupAll("_http._tcp", "example", 50*time.Millisecond, query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("bad: %v", entries)
+	}
+	if entries[0].Name != "a._http._tcp.example." || entries[0].Info != "new" {
+		t.Fatalf("bad: %v", entries[0])
+	}
+	if entries[1].Name != "b._http._tcp.example." {
+		t.Fatalf("bad: %v", entries[1])
+	}
+
+	// Errors from the query are returned
+	_, err = lookupAll("_http._tcp", "", time.Second, func(*QueryParam) error {
+		return fmt.Errorf("failed")
+	})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestLookupMap(t *testing.T) {
+	var zone multiZone
+	for _, instance := range []string{"a", "b"} {
+		s := makeService(t)
+		s.Instance = instance
+		s.Init()
+		zone = append(zone, s)
+	}
+	query := func(params *QueryParam) error {
+		state := newQueryState(params, discardQuery)
+		recs := zone.Records(dns.Question{
+			Name:  "_http._tcp.local.",
+			Qtype: dns.TypePTR,
+		})
+		state.handleResponse(&dns.Msg{Answer: recs}, nil)
+
+		// The second instance says goodbye
+		bye := &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   "_http._tcp.local.",
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+			},
+			Ptr: zone[1].(*MDNSService).instanceAddr,
+		}
+		state.handleResponse(&dns.Msg{Answer: []dns.RR{bye}}, nil)
+		return nil
+	}
+	entries, err := lookupMap("_http._tcp", "", time.Second, query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %v", entries)
+	}
+	if _, ok := entries[zone[0].(*MDNSService).instanceAddr]; !ok {
+		t.Fatalf("bad: %v", entries)
+	}
+}
+
+func TestLookupOnInterface(t *testing.T) {
+	// Use the loopback interface, which only has a loopback network
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var lo *net.Interface
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 {
+			lo = &ifaces[i]
+			break
+		}
+	}
+	if lo == nil {
+		t.Skip("no loopback interface")
+	}
+
+	query := func(params *QueryParam) error {
+		if params.Interface == nil || params.Interface.Name != lo.Name {
+			t.Fatalf("bad: %v", params.Interface)
+		}
+		params.Entries <- &ServiceEntry{Name: "a._http._tcp.local.", AddrV4: net.IPv4(127, 0, 0, 1)}
+		params.Entries <- &ServiceEntry{Name: "b._http._tcp.local.", AddrV4: net.IPv4(192, 0, 2, 1)}
+		params.Entries <- &ServiceEntry{Name: "c._http._tcp.local.", AddrV6: net.ParseIP("fe80::1"), AddrZone: lo.Name}
+		params.Entries <- &ServiceEntry{Name: "d._http._tcp.local.", AddrV6: net.ParseIP("fe80::2"), AddrZone: "other0"}
+		return nil
+	}
+	entries, err := lookupOnInterface("_http._tcp", lo.Name, time.Second, query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Name != "a._http._tcp.local." ||
+		entries[1].Name != "c._http._tcp.local." {
+		t.Fatalf("bad: %v", entries)
+	}
+
+	if _, err := lookupOnInterface("_http._tcp", "nonexistent0", time.Second, query); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestCountInstances(t *testing.T) {
+	var zone multiZone
+	for _, instance := range []string{"one", "two", "three"} {
+		s := makeService(t)
+		s.Instance = instance
+		s.Init()
+		zone = append(zone, s)
+	}
+	msgCh, send, stop := memoryResponder(zone)
+	defer stop()
+
+	// Answer twice, to ensure instances are only counted once
+	counting := func(q *dns.Msg) error {
+		if q.Question[0].Qtype != dns.TypePTR {
+			t.Fatalf("bad: %v", q)
+		}
+		send(q)
+		return send(q)
+	}
+	n, err := countInstances("_http._tcp.local.", 20*time.Millisecond, msgCh, counting)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestServiceExists(t *testing.T) {
+	msgCh, send, stop := memoryResponder(makeService(t))
+	defer stop()
+
+	// An advertised service is found without waiting for the timeout
+	start := time.Now()
+	found, err := serviceExists("_http._tcp.local.", time.Second, msgCh, send)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !found {
+		t.Fatalf("service not found")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("too slow: %v", elapsed)
+	}
+
+	// An absent one is not found once the timeout passes
+	found, err = serviceExists("_absent._tcp.local.", 20*time.Millisecond, msgCh, send)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if found {
+		t.Fatalf("absent service found")
+	}
+
+	// A service that is only saying goodbye is not found
+	goodbye := &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   "_http._tcp.local.",
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    0,
+		},
+		Ptr: "hostname._http._tcp.local.",
+	}
+	msgCh, send, stop = memoryResponder(staticZone{goodbye})
+	defer stop()
+	found, err = serviceExists("_http._tcp.local.", 20*time.Millisecond, msgCh, send)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if found {
+		t.Fatalf("goodbye service found")
+	}
+}
+
+func TestResolveInstance(t *testing.T) {
+	s := makeService(t)
+	msgCh, send, stop := memoryResponder(s)
+	defer stop()
+	query := func(ctx context.Context, name string, params *QueryParam) error {
+		state := newQueryState(params, send)
+		state.ctx = ctx
+		return runQuery(name, dns.TypeANY, state, msgCh)
+	}
+
+	// A known instance is resolved without waiting for the timeout
+	start := time.Now()
+	e, err := resolveInstance(strings.TrimSuffix(s.instanceAddr, "."), time.Second, query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if e.Name != s.instanceAddr || e.Port != 80 || e.AddrV4 == nil {
+		t.Fatalf("bad: %v", e)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("too slow: %v", elapsed)
+	}
+
+	// An unknown one times out
+	if _, err := resolveInstance("absent._http._tcp.local.", 20*time.Millisecond, query); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestClient_Reset(t *testing.T) {
+	first := makeService(t)
+	first.Instance = "first"
+	first.Init()
+	second := makeService(t)
+	second.Instance = "second"
+	second.Init()
+
+	// run simulates a query answered with the given records
+	c := &Client{cache: newEntryCache(), msgCh: make(chan *msgAddr, 1)}
+	run := func(recs []dns.RR) {
+		params := &QueryParam{Entries: make(chan *ServiceEntry, 4)}
+		c.lastQuery = newQueryState(params, discardQuery)
+		c.lastQuery.observe = c.cache.update
+		c.lastQuery.handleResponse(&dns.Msg{Answer: recs}, nil)
+	}
+
+	// The first query resolves one instance and leaves another partial
+	recs := first.Records(dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR})
+	partial := second.Records(dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR})
+	run(append(recs, partial[0], partial[1]))
+	c.msgCh <- &msgAddr{msg: &dns.Msg{Answer: recs}}
+	if len(c.Entries()) != 1 || len(c.InProgress()) != 1 {
+		t.Fatalf("bad: %v %v", c.Entries(), c.InProgress())
+	}
+
+	c.Reset()
+	if out := c.InProgress(); len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+	if len(c.msgCh) != 0 {
+		t.Fatalf("bad: %d", len(c.msgCh))
+	}
+
+	// Only the second query's results remain
+	run(second.Records(dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR}))
+	out := c.Entries()
+	if len(out) != 1 || out[0].Name != second.instanceAddr {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestClient_InProgress(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	c := &Client{}
+	if out := c.InProgress(); out != nil {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Resolve everything but the address
+	params := &QueryParam{Entries: make(chan *ServiceEntry, 4)}
+	c.lastQuery = newQueryState(params, discardQuery)
+	c.lastQuery.handleResponse(&dns.Msg{Answer: []dns.RR{recs[0], recs[1], recs[3]}}, nil)
+
+	out := c.InProgress()
+	if len(out) != 1 {
+		t.Fatalf("bad: %v", out)
+	}
+	e := out[0]
+	if e.Name != s.instanceAddr || e.Port != s.Port || e.Addr != nil {
+		t.Fatalf("bad: %v", e)
+	}
+	if !e.Incomplete {
+		t.Fatalf("not marked incomplete: %v", e)
+	}
+	if c.lastQuery.inprogress[s.instanceAddr].Incomplete {
+		t.Fatalf("in-progress entry modified")
+	}
+}
+
+func TestRunQuery_ReadyCheck(t *testing.T) {
+	start := time.Now()
+	ready := start.Add(50 * time.Millisecond)
+	var sent time.Time
+	send := func(q *dns.Msg) error {
+		if sent.IsZero() {
+			sent = time.Now()
+		}
+		return nil
+	}
+
+	params := &QueryParam{
+		Timeout: 10 * time.Millisecond,
+		Entries: make(chan *ServiceEntry, 4),
+		ReadyCheck: func() bool {
+			return time.Now().After(ready)
+		},
+		ReadyTimeout: time.Second,
+	}
+	msgCh := make(chan *msgAddr)
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sent.Before(ready) {
+		t.Fatalf("query sent before ready: %v", sent.Sub(start))
+	}
+
+	// Give up once the timeout passes
+	sent = time.Time{}
+	params.ReadyCheck = func() bool { return false }
+	params.ReadyTimeout = 20 * time.Millisecond
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sent.IsZero() {
+		t.Fatalf("query not sent")
+	}
+}
+
+func TestRunQuery_Retries(t *testing.T) {
+	sent := 0
+	send := func(q *dns.Msg) error {
+		sent++
+		return nil
+	}
+
+	// Retransmitted at 100ms and 300ms
+	params := &QueryParam{
+		Timeout: 500 * time.Millisecond,
+		Entries: make(chan *ServiceEntry, 4),
+		Retries: 2,
+	}
+	msgCh := make(chan *msgAddr)
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sent != 3 {
+		t.Fatalf("bad: %d", sent)
+	}
+
+	// Retransmits stop at the timeout
+	sent = 0
+	params.Timeout = 200 * time.Millisecond
+	params.Retries = 5
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sent != 2 {
+		t.Fatalf("bad: %d", sent)
+	}
+}
+
+func TestRunQuery_DrainOnTimeout(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	// The completing packet is queued as the deadline fires, so
+	// without draining it may be dropped
+	for i := 0; i < 20; i++ {
+		msgCh := make(chan *msgAddr, 1)
+		msgCh <- &msgAddr{msg: &dns.Msg{Answer: recs}}
+
+		entries := make(chan *ServiceEntry, 4)
+		params := &QueryParam{
+			Timeout:        time.Nanosecond,
+			Entries:        entries,
+			DrainOnTimeout: true,
+		}
+		if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, discardQuery), msgCh); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("bad: %d", len(entries))
+		}
+	}
+}
+
+func BenchmarkQuery_OneShot(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		params := &QueryParam{
+			Service: "_bench._tcp",
+			Timeout: time.Millisecond,
+			Entries: make(chan *ServiceEntry, 4),
+		}
+		if err := Query(params); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkClient_Query(b *testing.B) {
+	c, err := NewClient()
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		params := &QueryParam{
+			Service: "_bench._tcp",
+			Timeout: time.Millisecond,
+			Entries: make(chan *ServiceEntry, 4),
+		}
+		if err := c.Query(params); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestRunQuery_Header(t *testing.T) {
+	var headers []dns.MsgHdr
+	send := func(q *dns.Msg) error {
+		buf, err := q.Pack()
+		if err != nil {
+			return err
+		}
+		var out dns.Msg
+		if err := out.Unpack(buf); err != nil {
+			return err
+		}
+		headers = append(headers, out.MsgHdr)
+		return nil
+	}
+	params := &QueryParam{
+		Timeout: time.Millisecond,
+		Entries: make(chan *ServiceEntry, 4),
+	}
+	msgCh := make(chan *msgAddr)
+
+	// Defaults to a standard query without recursion
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if h := headers[0]; h.Opcode != dns.OpcodeQuery || h.RecursionDesired || h.Authoritative {
+		t.Fatalf("bad: %v", h)
+	}
+
+	params.Authoritative = true
+	params.RecursionDesired = true
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if h := headers[1]; h.Opcode != dns.OpcodeQuery || !h.RecursionDesired || !h.Authoritative {
+		t.Fatalf("bad: %v", h)
+	}
+
+	// Recursion is invalid for other opcodes
+	params.Opcode = dns.OpcodeNotify
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err == nil {
+		t.Fatalf("expected error")
+	}
+	params.RecursionDesired = false
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if h := headers[2]; h.Opcode != dns.OpcodeNotify {
+		t.Fatalf("bad: %v", h)
+	}
+
+	params.Opcode = 99
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRunQuery_NonZeroID(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	resp := &dns.Msg{Answer: recs}
+	resp.Id = 0xbeef
+	resp.Response = true
+	msgCh := make(chan *msgAddr, 1)
+	msgCh <- &msgAddr{msg: resp}
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Timeout: 20 * time.Millisecond,
+		Entries: entries,
+	}
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, discardQuery), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+}
+
+func TestIsAvailable(t *testing.T) {
+	defer func() { interfaces = net.Interfaces }()
+
+	cases := []struct {
+		ifaces    []net.Interface
+		available bool
+	}{
+		{nil, false},
+		{[]net.Interface{
+			{Name: "lo", Flags: net.FlagUp | net.FlagLoopback | net.FlagMulticast},
+			{Name: "eth0", Flags: net.FlagMulticast},
+			{Name: "tun0", Flags: net.FlagUp | net.FlagPointToPoint},
+		}, false},
+		{[]net.Interface{
+			{Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			{Name: "eth0", Flags: net.FlagUp | net.FlagBroadcast | net.FlagMulticast},
+		}, true},
+	}
+	for _, c := range cases {
+		ifaces := c.ifaces
+		interfaces = func() ([]net.Interface, error) {
+			return ifaces, nil
+		}
+		ok, err := IsAvailable()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if ok != c.available {
+			t.Fatalf("bad: %v %v", ifaces, ok)
+		}
+	}
+
+	interfaces = func() ([]net.Interface, error) {
+		return nil, fmt.Errorf("no interfaces")
+	}
+	if _, err := IsAvailable(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestClient_HandleResponse_LastSeen(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	cache := newEntryCache()
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.observe = cache.update
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	e := <-entries
+	if e.LastSeen.IsZero() {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// Re-announcing advances LastSeen, without a new emission
+	time.Sleep(5 * time.Millisecond)
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	if len(entries) != 0 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if !state.inprogress[s.instanceAddr].LastSeen.After(e.LastSeen) {
+		t.Fatalf("LastSeen not advanced")
+	}
+	out := cache.snapshot(time.Now(), 0)
+	if len(out) != 1 || !out[0].LastSeen.After(e.LastSeen) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestClient_HandleResponse_UnicastFollowUp(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	responder := &net.UDPAddr{IP: net.ParseIP("192.168.1.50"), Port: 5353}
+
+	for _, unicast := range []bool{false, true} {
+		var multicast, unicastTo []net.Addr
+		state := newQueryState(&QueryParam{
+			Entries:         make(chan *ServiceEntry, 4),
+			UnicastFollowUp: unicast,
+		}, func(q *dns.Msg) error {
+			multicast = append(multicast, nil)
+			return nil
+		})
+		state.sendTo = func(q *dns.Msg, addr net.Addr) error {
+			unicastTo = append(unicastTo, addr)
+			return nil
+		}
+
+		// Only the PTR is known, so a follow up is needed
+		state.handleResponse(&dns.Msg{Answer: recs[:1]}, responder)
+		if unicast {
+			if len(multicast) != 0 || len(unicastTo) != 1 || unicastTo[0] != responder {
+				t.Fatalf("bad: %v %v", multicast, unicastTo)
+			}
+		} else if len(multicast) != 1 || len(unicastTo) != 0 {
+			t.Fatalf("bad: %v %v", multicast, unicastTo)
+		}
+	}
+}
+
+func TestQueryState_UnicastID(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	responder := &net.UDPAddr{IP: net.ParseIP("192.168.1.50"), Port: 5353}
+
+	var sent []*dns.Msg
+	state := newQueryState(&QueryParam{
+		Entries:         make(chan *ServiceEntry, 4),
+		UnicastFollowUp: true,
+	}, discardQuery)
+	state.sendTo = func(q *dns.Msg, addr net.Addr) error {
+		sent = append(sent, q)
+		return nil
+	}
+	state.handleResponse(&dns.Msg{Answer: recs[:1]}, responder)
+	if len(sent) != 1 || sent[0].Id == 0 {
+		t.Fatalf("bad: %v", sent)
+	}
+
+	// Replies from the responder queried directly must match its ID
+	reply := func(id uint16, src net.Addr) *msgAddr {
+		resp := &dns.Msg{Answer: recs}
+		resp.Id = id
+		resp.Response = true
+		return &msgAddr{msg: resp, src: src}
+	}
+	if !state.accept(reply(sent[0].Id, responder)) {
+		t.Fatalf("matching ID dropped")
+	}
+	bad := sent[0].Id%65534 + 1
+	if state.accept(reply(bad, responder)) {
+		t.Fatalf("mismatched ID accepted")
+	}
+
+	// Multicast responses carry no ID, or any ID from other sources
+	if !state.accept(reply(0, responder)) {
+		t.Fatalf("zero ID dropped")
+	}
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.1.51"), Port: 5353}
+	if !state.accept(reply(bad, other)) {
+		t.Fatalf("multicast response dropped")
+	}
+}
+
+func TestClient_HandleResponse_FollowUpWindow(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	var followUps []string
+	send := func(q *dns.Msg) error {
+		followUps = append(followUps, q.Question[0].Name)
+		return nil
+	}
+	params := &QueryParam{
+		Entries:        make(chan *ServiceEntry, 4),
+		FollowUpWindow: 20 * time.Millisecond,
+	}
+	state := newQueryState(params, send)
+
+	// The same PTR from two responders only needs one follow up
+	state.handleResponse(&dns.Msg{Answer: recs[:1]}, nil)
+	state.handleResponse(&dns.Msg{Answer: recs[:1]}, nil)
+	if !reflect.DeepEqual(followUps, []string{s.instanceAddr}) {
+		t.Fatalf("bad: %v", followUps)
+	}
+
+	// Once the window passes, another is sent in case the first was lost
+	time.Sleep(25 * time.Millisecond)
+	state.handleResponse(&dns.Msg{Answer: recs[:1]}, nil)
+	if len(followUps) != 2 {
+		t.Fatalf("bad: %v", followUps)
+	}
+
+	// Once resolved, seeing the PTR again sends nothing
+	state.handleResponse(&dns.Msg{Answer: recs}, nil)
+	time.Sleep(25 * time.Millisecond)
+	state.handleResponse(&dns.Msg{Answer: recs[:1]}, nil)
+	if len(followUps) != 2 {
+		t.Fatalf("bad: %v", followUps)
+	}
+}
+
+func TestRunQuery_OnFirstResponse(t *testing.T) {
+	s := makeService(t)
+	msgCh, send, stop := memoryResponder(s)
+	defer stop()
+
+	// Answer twice, so there are several responses
+	twice := func(q *dns.Msg) error {
+		send(q)
+		return send(q)
+	}
+
+	entries := make(chan *ServiceEntry, 4)
+	fired := 0
+	params := &QueryParam{
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+		OnFirstResponse: func() {
+			if len(entries) != 0 {
+				t.Fatalf("entry emitted before first response")
+			}
+			fired++
+		},
+	}
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, twice), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fired != 1 {
+		t.Fatalf("bad: %d", fired)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+}
+
+func TestRunQuery_RotateQueries(t *testing.T) {
+	var packets [][]byte
+	send := func(q *dns.Msg) error {
+		buf, err := q.Pack()
+		if err != nil {
+			return err
+		}
+		packets = append(packets, buf)
+		return nil
+	}
+	params := &QueryParam{}
+
+	// Identical by default, as multicast queries carry a zero ID
+	state := newQueryState(params, send)
+	state.send(state.newMsg("_http._tcp.local.", dns.TypePTR))
+	state.send(state.newMsg("_http._tcp.local.", dns.TypePTR))
+	if !bytes.Equal(packets[0], packets[1]) {
+		t.Fatalf("bad: %v %v", packets[0], packets[1])
+	}
+
+	// Successive queries differ in their padding when rotated
+	packets = nil
+	params.RotateQueries = true
+	state = newQueryState(params, send)
+	for i := 0; i < 3; i++ {
+		state.send(state.newMsg("_http._tcp.local.", dns.TypePTR))
+	}
+	for i := 1; i < len(packets); i++ {
+		if len(packets[i-1]) == len(packets[i]) {
+			t.Fatalf("bad: %v %v", packets[i-1], packets[i])
+		}
+	}
+
+	// The padding is carried in an EDNS option
+	var m dns.Msg
+	if err := m.Unpack(packets[0]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	opt := m.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("bad: %v", m)
+	}
+	if _, ok := opt.Option[0].(*dns.EDNS0_PADDING); !ok {
+		t.Fatalf("bad: %v", opt.Option[0])
+	}
+}
+
+// signedZone adds a signature to the records of a zone
+type signedZone struct {
+	Zone
+}
+
+func (s signedZone) Records(q dns.Question) []dns.RR {
+	recs := s.Zone.Records(q)
+	if len(recs) == 0 {
+		return recs
+	}
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeRRSIG,
+			Class:  dns.ClassINET,
+			Ttl:    120,
+		},
+		TypeCovered: recs[0].Header().Rrtype,
+		SignerName:  "local.",
+	}
+	return append(recs, sig)
+}
+
+func TestRunQuery_DNSSEC(t *testing.T) {
+	s := makeService(t)
+	for _, signed := range []bool{true, false} {
+		var zone Zone = s
+		if signed {
+			zone = signedZone{s}
+		}
+		msgCh, send, stop := memoryResponder(zone)
+
+		var do bool
+		checking := func(q *dns.Msg) error {
+			opt := q.IsEdns0()
+			do = opt != nil && opt.Do()
+			return send(q)
+		}
+		validated := 0
+		entries := make(chan *ServiceEntry, 4)
+		params := &QueryParam{
+			Timeout: 50 * time.Millisecond,
+			Entries: entries,
+			DNSSEC:  true,
+			Validate: func(resp *dns.Msg) bool {
+				validated++
+				return true
+			},
+		}
+		err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, checking), msgCh)
+		stop()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !do {
+			t.Fatalf("DO bit not set")
+		}
+		if len(entries) != 1 {
+			t.Fatalf("bad: %d", len(entries))
+		}
+		if e := <-entries; e.Signed != signed {
+			t.Fatalf("bad: %v %v", signed, e)
+		}
+		if signed != (validated > 0) {
+			t.Fatalf("bad: %v %d", signed, validated)
+		}
+	}
+}
+
+func TestRunQuery_FamilyStrategy(t *testing.T) {
+	s := makeService(t)
+	grace := 20 * time.Millisecond
+
+	// record returns a send function noting when each query is sent
+	record := func(sent *[]time.Time, send sendFunc) sendFunc {
+		return func(q *dns.Msg) error {
+			*sent = append(*sent, time.Now())
+			if send != nil {
+				return send(q)
+			}
+			return nil
+		}
+	}
+
+	// No responses, so IPv4 is used once the grace period elapses
+	var v4, v6 []time.Time
+	params := &QueryParam{
+		Timeout:        60 * time.Millisecond,
+		Entries:        make(chan *ServiceEntry, 4),
+		FamilyStrategy: V6ThenV4,
+		FamilyGrace:    grace,
+	}
+	state := newQueryState(params, discardQuery)
+	state.sendV4 = record(&v4, nil)
+	state.sendV6 = record(&v6, nil)
+	start := time.Now()
+	if err := runQuery("_http._tcp.local.", dns.TypePTR, state, make(chan *msgAddr)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(v6) != 1 || len(v4) != 1 {
+		t.Fatalf("bad: %v %v", v6, v4)
+	}
+	if v4[0].Sub(start) < grace || v4[0].Before(v6[0]) {
+		t.Fatalf("bad: %v %v %v", start, v6, v4)
+	}
+
+	// IPv4 is never used once IPv6 gets a response
+	msgCh, send, stop := memoryResponder(s)
+	defer stop()
+	v4, v6 = nil, nil
+	state = newQueryState(params, discardQuery)
+	state.sendV4 = record(&v4, nil)
+	state.sendV6 = record(&v6, send)
+	if err := runQuery("_http._tcp.local.", dns.TypeANY, state, msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(v6) == 0 || len(v4) != 0 {
+		t.Fatalf("bad: %v %v", v6, v4)
+	}
+
+	// IPv4 is used at once if IPv6 fails, as without an IPv6 route
+	v4, v6 = nil, nil
+	fail := func(q *dns.Msg) error {
+		return fmt.Errorf("Failed to send query")
+	}
+	state = newQueryState(params, discardQuery)
+	state.sendV4 = record(&v4, nil)
+	state.sendV6 = record(&v6, fail)
+	start = time.Now()
+	if err := runQuery("_http._tcp.local.", dns.TypePTR, state, make(chan *msgAddr)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(v6) != 1 || len(v4) != 1 {
+		t.Fatalf("bad: %v %v", v6, v4)
+	}
+	if v4[0].Sub(start) >= grace {
+		t.Fatalf("bad: %v %v", start, v4)
+	}
+
+	// The query fails only if both families do
+	state = newQueryState(params, discardQuery)
+	state.sendV4 = fail
+	state.sendV6 = fail
+	if err := runQuery("_http._tcp.local.", dns.TypePTR, state, make(chan *msgAddr)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRunQuery_WildcardProtocol(t *testing.T) {
+	tcp := makeService(t)
+	tcp.Service = "_custom._tcp"
+	tcp.Init()
+	udp := makeService(t)
+	udp.Service = "_custom._udp"
+	udp.Init()
+	msgCh, send, stop := memoryResponder(multiZone{tcp, udp})
+	defer stop()
+
+	names, err := serviceNames("_custom", "local")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"_custom._tcp.local.", "_custom._udp.local."}) {
+		t.Fatalf("bad: %v", names)
+	}
+
+	var questions []string
+	recording := func(q *dns.Msg) error {
+		for _, question := range q.Question {
+			questions = append(questions, question.Name)
+		}
+		return send(q)
+	}
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+	}
+	state := newQueryState(params, recording)
+	state.alsoAsk = names[1:]
+	if err := runQuery(names[0], dns.TypeANY, state, msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(questions, names) {
+		t.Fatalf("bad: %v", questions)
+	}
+
+	protocols := make(map[string]string)
+	for len(entries) > 0 {
+		e := <-entries
+		protocols[e.Name] = e.Protocol
+	}
+	expect := map[string]string{
+		tcp.instanceAddr: "_tcp",
+		udp.instanceAddr: "_udp",
+	}
+	if !reflect.DeepEqual(protocols, expect) {
+		t.Fatalf("bad: %v", protocols)
+	}
+
+	// The base service label is validated
+	for _, service := range []string{"custom", "_", "_-custom", "_123", "_toolongservicename"} {
+		if _, err := serviceNames(service, "local"); err == nil {
+			t.Fatalf("expected error for %q", service)
+		}
+	}
+}
+
+func TestClient_HandleResponse_SendError(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	// The label of this instance is too long, so querying it fails
+	bad := &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   "_http._tcp.local.",
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    120,
+		},
+		Ptr: fmt.Sprintf("%070d._http._tcp.local.", 0),
+	}
+
+	packing := func(q *dns.Msg) error {
+		_, err := q.Pack()
+		return err
+	}
+	entries := make(chan *ServiceEntry, 4)
+	errors := make(chan error, 4)
+	metrics := &fakeRecorder{}
+	params := &QueryParam{Entries: entries, Errors: errors, Metrics: metrics}
+	state := newQueryState(params, packing)
+	state.handleResponse(&dns.Msg{Answer: append([]dns.RR{bad}, recs...)}, nil)
+
+	if len(errors) != 1 {
+		t.Fatalf("bad: %d", len(errors))
+	}
+	if metrics.sendErrors != 1 {
+		t.Fatalf("bad: %d", metrics.sendErrors)
+	}
+
+	// The other instance still resolves
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; e.Name != s.instanceAddr {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestRunQuery_Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	params := &QueryParam{
+		Timeout: time.Second,
+		Entries: make(chan *ServiceEntry, 4),
+	}
+	state := newQueryState(params, discardQuery)
+	state.ctx = ctx
+	start := time.Now()
+	if err := runQuery("_http._tcp.local.", dns.TypePTR, state, make(chan *msgAddr)); err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= params.Timeout {
+		t.Fatalf("bad: %v", elapsed)
+	}
+}
+
+func TestQueryContext_NoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	params := &QueryParam{
+		Service: "_leak._tcp",
+		Domain:  "local",
+		Timeout: time.Second,
+		Entries: make(chan *ServiceEntry, 4),
+	}
+	if err := QueryContext(ctx, params); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The receive goroutines are stopped when the query returns
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %d %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunQuery_BlockUntilSent(t *testing.T) {
+	var zone multiZone
+	for i := 0; i < 5; i++ {
+		s := makeService(t)
+		s.Instance = fmt.Sprintf("instance%d", i)
+		s.Init()
+		zone = append(zone, s)
+	}
+
+	for _, block := range []bool{false, true} {
+		msgCh, send, stop := memoryResponder(zone)
+
+		// A slow reader of an unbuffered channel
+		entries := make(chan *ServiceEntry)
+		received := make(chan int)
+		go func() {
+			n := 0
+			for _ = range entries {
+				n++
+				time.Sleep(5 * time.Millisecond)
+			}
+			received <- n
+		}()
+
+		params := &QueryParam{
+			Timeout:        200 * time.Millisecond,
+			Entries:        entries,
+			BlockUntilSent: block,
+		}
+		err := runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh)
+		stop()
+		close(entries)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		n := <-received
+		if block && n != len(zone) {
+			t.Fatalf("bad: %d", n)
+		}
+		if !block && n == len(zone) {
+			t.Fatalf("expected dropped entries: %d", n)
+		}
+	}
+}
+
+func TestAddrFamilies(t *testing.T) {
+	cases := []struct {
+		addrs        []net.Addr
+		hasV4, hasV6 bool
+	}{
+		{nil, false, false},
+		{[]net.Addr{&net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(8, 32)}}, true, false},
+		{[]net.Addr{&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}}, false, true},
+		{[]net.Addr{
+			&net.IPAddr{IP: net.IPv4(192, 168, 0, 1)},
+			&net.IPAddr{IP: net.ParseIP("2001:db8::1")},
+		}, true, true},
+	}
+	for _, c := range cases {
+		hasV4, hasV6 := addrFamilies(c.addrs)
+		if hasV4 != c.hasV4 || hasV6 != c.hasV6 {
+			t.Fatalf("bad: %v %v %v", c.addrs, hasV4, hasV6)
+		}
+	}
+}
+
+func TestClient_DisableFamily(t *testing.T) {
+	if _, err := newClient(true, true); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	c, err := newClient(false, true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+	if c.ipv4List == nil || c.ipv6List != nil {
+		t.Fatalf("bad: %v %v", c.ipv4List, c.ipv6List)
+	}
+
+	// Rebinding keeps the family disabled
+	if err := c.Rebind(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if c.ipv4List == nil || c.ipv6List != nil {
+		t.Fatalf("bad: %v %v", c.ipv4List, c.ipv6List)
+	}
+
+	// Disabling the only bound family leaves nothing to query over
+	params := &QueryParam{
+		Service:     "_http._tcp",
+		Timeout:     10 * time.Millisecond,
+		Entries:     make(chan *ServiceEntry, 4),
+		DisableIPv4: true,
+	}
+	if err := c.Query(params); err == nil {
+		t.Fatalf("expected error")
+	}
+	params.DisableIPv4 = false
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestClient_RecvTruncated(t *testing.T) {
+	var zone staticZone
+	for i := 0; i < 50; i++ {
+		zone = append(zone, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   "hostname._http._tcp.local.",
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    120,
+			},
+			Txt: []string{fmt.Sprintf("record=%d,%0100d", i, 0)},
+		})
+	}
+	serv := &Server{config: &Config{Zone: zone, MaxResponseSize: 1000}}
+	query := new(dns.Msg)
+	query.SetQuestion("hostname._http._tcp.local.", dns.TypeTXT)
+	buf, err := serv.pack(serv.respond(query, nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c := &Client{ipv4List: l, closedCh: make(chan struct{})}
+	msgCh := make(chan *msgAddr, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.recv(l, msgCh)
+	}()
+	defer func() {
+		c.closeLock.Lock()
+		c.closed = true
+		c.closeLock.Unlock()
+		close(c.closedCh)
+		l.Close()
+		<-done
+	}()
+
+	// The trimmed response is passed on with the records it holds
+	conn, err := net.DialUDP("udp4", nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case m := <-msgCh:
+		if !m.msg.Truncated || len(m.msg.Answer) == 0 {
+			t.Fatalf("bad: %v", m.msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("truncated response dropped")
+	}
+}
+
+func TestClient_SendQueryErrors(t *testing.T) {
+	bind := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return conn
+	}
+	open, closed := bind(), bind()
+	defer open.Close()
+	closed.Close()
+
+	c := &Client{}
+	m := new(dns.Msg)
+	m.SetQuestion("_http._tcp.local.", dns.TypePTR)
+
+	// A write failure on the only family is returned
+	if err := c.sendQueryOn(m, closed, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// A partial success proceeds
+	if err := c.sendQueryOn(m, open, closed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// And a failed initial query fails the query
+	params := &QueryParam{
+		Timeout: time.Second,
+		Entries: make(chan *ServiceEntry, 4),
+	}
+	send := func(q *dns.Msg) error {
+		return c.sendQueryOn(q, closed, nil)
+	}
+	if err := runQuery("_http._tcp.local.", dns.TypePTR, newQueryState(params, send), make(chan *msgAddr)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestClient_HandleResponse_QueryType(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	for _, qtype := range []uint16{0, dns.TypePTR} {
+		var questions []dns.Question
+		send := func(q *dns.Msg) error {
+			questions = append(questions, q.Question...)
+			return nil
+		}
+		params := &QueryParam{
+			Entries:   make(chan *ServiceEntry, 4),
+			QueryType: qtype,
+		}
+		state := newQueryState(params, send)
+
+		// Only the PTR is known, so the instance is followed up
+		state.handleResponse(&dns.Msg{Answer: recs[:1]}, nil)
+		var types []uint16
+		for _, q := range questions {
+			if q.Name != s.instanceAddr {
+				t.Fatalf("bad: %v", q)
+			}
+			types = append(types, q.Qtype)
+		}
+		expect := []uint16{dns.TypeANY}
+		if qtype == dns.TypePTR {
+			expect = []uint16{dns.TypeSRV, dns.TypeTXT}
+		}
+		if !reflect.DeepEqual(types, expect) {
+			t.Fatalf("bad: %v", types)
+		}
+	}
+}
+
+func TestRunQuery_WantUnicastResponse(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	for _, unicast := range []bool{false, true} {
+		var questions []dns.Question
+		send := func(q *dns.Msg) error {
+			questions = append(questions, q.Question...)
+			return nil
+		}
+		params := &QueryParam{
+			Entries:             make(chan *ServiceEntry, 4),
+			Timeout:             10 * time.Millisecond,
+			QueryType:           dns.TypePTR,
+			WantUnicastResponse: unicast,
+		}
+		state := newQueryState(params, send)
+		state.alsoAsk = []string{"_http._udp.local."}
+		if err := runQuery("_http._tcp.local.", dns.TypePTR, state, make(chan *msgAddr)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Follow ups ask for the same kind of response
+		state.handleResponse(&dns.Msg{Answer: recs[:1]}, nil)
+		if len(questions) != 4 {
+			t.Fatalf("bad: %v", questions)
+		}
+		expect := uint16(dns.ClassINET)
+		if unicast {
+			expect |= 1 << 15
+		}
+		for _, q := range questions {
+			if q.Qclass != expect {
+				t.Fatalf("bad: %v %v", unicast, q)
+			}
+		}
+	}
+}
+
+// exactZone is a Zone answering only with the records whose name and
+// type match the question, volunteering nothing else
+type exactZone struct {
+	Zone
+}
+
+func (z exactZone) Records(q dns.Question) []dns.RR {
+	var recs []dns.RR
+	for _, rr := range z.Zone.Records(dns.Question{Name: q.Name, Qtype: dns.TypeANY}) {
+		if rr.Header().Name == q.Name && rr.Header().Rrtype == q.Qtype {
+			recs = append(recs, rr)
+		}
+	}
+	return recs
+}
+
+func TestRunQuery_QueryTypeAddresses(t *testing.T) {
+	s := makeService(t)
+	msgCh, send, stop := memoryResponder(exactZone{s})
+	defer stop()
+
+	entries := make(chan *ServiceEntry, 4)
+	params := &QueryParam{
+		Timeout:   50 * time.Millisecond,
+		Entries:   entries,
+		QueryType: dns.TypePTR,
+	}
+	if err := runQuery("_http._tcp.local.", dns.TypePTR, newQueryState(params, send), msgCh); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; e.Name != s.instanceAddr || !e.AddrV4.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestClient_HandleResponse_StripTrailingDot(t *testing.T) {
+	s := makeService(t)
+	recs := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+
+	for _, strip := range []bool{false, true} {
+		entries := make(chan *ServiceEntry, 4)
+		params := &QueryParam{Entries: entries, StripTrailingDot: strip}
+		state := newQueryState(params, discardQuery)
+		state.handleResponse(&dns.Msg{Answer: recs}, nil)
+
+		e := <-entries
+		expect := s.instanceAddr
+		if strip {
+			expect = "hostname._http._tcp.local"
+		}
+		if e.Name != expect || e.FQDN != s.instanceAddr {
+			t.Fatalf("bad: %v %v", e.Name, e.FQDN)
+		}
+	}
+}
+
+func TestClient_StartMaintenance(t *testing.T) {
+	c := &Client{cache: newEntryCache(), closedCh: make(chan struct{})}
+	c.cache.update(&ServiceEntry{
+		Name:      "expired._http._tcp.local.",
+		ExpiresAt: time.Now().Add(-time.Second),
+	})
+
+	interval := 10 * time.Millisecond
+	c.StartMaintenance(interval)
+	defer c.Close()
+
+	// The janitor should evict the entry within a few intervals
+	deadline := time.Now().Add(20 * interval)
+	for {
+		c.cache.lock.Lock()
+		n := len(c.cache.entries)
+		c.cache.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired entry not evicted")
+		}
+		time.Sleep(interval / 2)
+	}
+}
+
+// countingWriter is a packetWriter that counts writes, failing them
+// with err if set
+type countingWriter struct {
+	writes int
+	err    error
+}
+
+func (w *countingWriter) WriteTo(b []byte, addr net.Addr) (int, error) {
+	w.writes++
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(b), nil
+}
+
+func TestClient_Refresh(t *testing.T) {
+	old := refreshTimeout
+	defer func() { refreshTimeout = old }()
+	refreshTimeout = 20 * time.Millisecond
+
+	c := &Client{
+		cache:         newEntryCache(),
+		msgCh:         make(chan *msgAddr, 32),
+		RefreshWindow: time.Minute,
+	}
+	now := time.Now()
+	for _, name := range []string{"a", "b", "c"} {
+		c.cache.update(&ServiceEntry{
+			Name:      name + "._http._tcp.local.",
+			ExpiresAt: now.Add(time.Second),
+		})
+	}
+	last := newQueryState(&QueryParam{}, discardQuery)
+	c.lastQuery = last
+
+	// The entries are refreshed together, leaving the last query alone
+	start := time.Now()
+	c.maintainOnce(now)
+	if elapsed := time.Since(start); elapsed >= 2*refreshTimeout {
+		t.Fatalf("too slow: %v", elapsed)
+	}
+	if c.lastQuery != last {
+		t.Fatalf("last query replaced")
+	}
+}
+
+func TestMulticaster_IPv6Unreachable(t *testing.T) {
+	v4 := &countingWriter{}
+	v6 := &countingWriter{
+		err: &net.OpError{
+			Op:  "write",
+			Net: "udp6",
+			Err: &os.SyscallError{Syscall: "sendto", Err: syscall.ENETUNREACH},
+		},
+	}
+	var reported []error
+	m := &multicaster{
+		ipv4: v4,
+		ipv6: v6,
+		onUnreachable: func(err error) {
+			reported = append(reported, err)
+		},
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	for i := 0; i < 3; i++ {
+		if err := m.send(q); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if v4.writes != 3 || v6.writes != 1 {
+		t.Fatalf("bad: %d %d", v4.writes, v6.writes)
+	}
+	if len(reported) != 1 {
+		t.Fatalf("bad: %v", reported)
+	}
+
+	// Nor is IPv6 tried when asked for alone
+	m.sendV6(q)
+	if v6.writes != 1 {
+		t.Fatalf("bad: %d", v6.writes)
+	}
+}
+
+func TestMulticaster_Parallel(t *testing.T) {
+	v4 := &countingWriter{}
+	v6 := &countingWriter{}
+	m := &multicaster{ipv4: v4, ipv6: v6, parallel: true, logf: logf}
+
+	q := new(dns.Msg)
+	q.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	if err := m.send(q); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v4.writes != 1 || v6.writes != 1 {
+		t.Fatalf("bad: %d %d", v4.writes, v6.writes)
+	}
+
+	// A failure on one family alone is not an error
+	v4.err = fmt.Errorf("v4 down")
+	if err := m.send(q); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Failures on both are reported together
+	v6.err = fmt.Errorf("v6 down")
+	err := m.send(q)
+	if err == nil || !strings.Contains(err.Error(), "v4 down") ||
+		!strings.Contains(err.Error(), "v6 down") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// slowWriter is a packetWriter whose writes take delay, as when a
+// socket's send buffer is full
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w *slowWriter) WriteTo(b []byte, addr net.Addr) (int, error) {
+	time.Sleep(w.delay)
+	return len(b), nil
+}
+
+func benchmarkMulticaster(b *testing.B, parallel bool) {
+	m := &multicaster{
+		ipv4:     &slowWriter{delay: 50 * time.Microsecond},
+		ipv6:     &slowWriter{delay: 50 * time.Microsecond},
+		parallel: parallel,
+		logf:     logf,
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("_http._tcp.local.", dns.TypePTR)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.send(q); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkMulticaster_SerialSend(b *testing.B) {
+	benchmarkMulticaster(b, false)
+}
+
+func BenchmarkMulticaster_ParallelSend(b *testing.B) {
+	benchmarkMulticaster(b, true)
+}
+
+func TestClient_MaxEntryAge(t *testing.T) {
+	c := &Client{cache: newEntryCache(), MaxEntryAge: time.Minute}
+	now := time.Now()
+	c.cache.update(&ServiceEntry{
+		Name:      "old._http._tcp.local.",
+		LastSeen:  now.Add(-2 * time.Minute),
+		ExpiresAt: now.Add(time.Hour),
+	})
+	c.cache.update(&ServiceEntry{
+		Name:      "new._http._tcp.local.",
+		LastSeen:  now,
+		ExpiresAt: now.Add(time.Hour),
+	})
+
+	// The old entry goes, though its TTL has not passed
+	out := c.Entries()
+	if len(out) != 1 || out[0].Name != "new._http._tcp.local." {
+		t.Fatalf("bad: %v", out)
+	}
+	if len(c.cache.entries) != 1 {
+		t.Fatalf("bad: %v", c.cache.entries)
+	}
+}
+
+func TestClient_MulticastTTL(t *testing.T) {
+	c, err := newClient(false, true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer c.Close()
+
+	ttl := func() int {
+		n, err := ipv4.NewPacketConn(c.ipv4List).MulticastTTL()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return n
+	}
+	params := &QueryParam{
+		Service: "_ttl._tcp",
+		Timeout: time.Millisecond,
+		Entries: make(chan *ServiceEntry, 4),
+	}
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := ttl(); n != 255 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	params.MulticastTTL = 2
+	if err := c.Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := ttl(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+}
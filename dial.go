@@ -0,0 +1,140 @@
+package mdns
+
+import (
+	"code.google.com/p/go.net/context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DialPolicy orders the entries found for a service into the order in
+// which DialService tries them
+type DialPolicy func(entries []*ServiceEntry) []*ServiceEntry
+
+// PriorityPolicy is the default DialPolicy. It orders entries by their
+// SRV priority, lowest first, and then by their weight, highest first.
+func PriorityPolicy(entries []*ServiceEntry) []*ServiceEntry {
+	sorted := make([]*ServiceEntry, len(entries))
+	copy(sorted, entries)
+	sort.Stable(prioritySorter(sorted))
+	return sorted
+}
+
+// prioritySorter implements sort.Interface for PriorityPolicy
+type prioritySorter []*ServiceEntry
+
+func (p prioritySorter) Len() int      { return len(p) }
+func (p prioritySorter) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p prioritySorter) Less(i, j int) bool {
+	if p[i].Priority != p[j].Priority {
+		return p[i].Priority < p[j].Priority
+	}
+	return p[i].Weight > p[j].Weight
+}
+
+// WeightPolicy is a DialPolicy that orders entries by their SRV weight,
+// highest first, ignoring priority except to break ties
+func WeightPolicy(entries []*ServiceEntry) []*ServiceEntry {
+	sorted := make([]*ServiceEntry, len(entries))
+	copy(sorted, entries)
+	sort.Stable(weightSorter(sorted))
+	return sorted
+}
+
+// weightSorter implements sort.Interface for WeightPolicy
+type weightSorter []*ServiceEntry
+
+func (w weightSorter) Len() int      { return len(w) }
+func (w weightSorter) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+func (w weightSorter) Less(i, j int) bool {
+	if w[i].Weight != w[j].Weight {
+		return w[i].Weight > w[j].Weight
+	}
+	return w[i].Priority < w[j].Priority
+}
+
+// RandomPolicy is a DialPolicy that orders entries randomly, spreading
+// connections evenly across the instances
+func RandomPolicy(entries []*ServiceEntry) []*ServiceEntry {
+	shuffled := make([]*ServiceEntry, len(entries))
+	for i, j := range rand.Perm(len(entries)) {
+		shuffled[i] = entries[j]
+	}
+	return shuffled
+}
+
+// DialService browses for a service in the local domain and connects to
+// the best instance found according to PriorityPolicy, trying the next
+// instance whenever a connection fails. If the context has a deadline,
+// the browse takes at most half the time left before it.
+func DialService(ctx context.Context, service string) (net.Conn, error) {
+	return DialServicePolicy(ctx, service, PriorityPolicy)
+}
+
+// DialServicePolicy is like DialService, but tries the instances in the
+// order given by the policy
+func DialServicePolicy(ctx context.Context, service string, policy DialPolicy) (net.Conn, error) {
+	return dialService(ctx, service, policy, QueryContext)
+}
+
+// dialService is used to browse for a service with the given query
+// function, and to dial its instances in the order of the policy
+func dialService(ctx context.Context, service string, policy DialPolicy,
+	query func(context.Context, *QueryParam) error) (net.Conn, error) {
+	// Browse for the instances
+	entries := make(chan *ServiceEntry, 32)
+	params := DefaultParams(service)
+	params.Entries = entries
+
+	// Browse for at most half the time left before the deadline, so
+	// the browse ends on its own with time left to dial
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := deadline.Sub(time.Now()) / 2; left > 0 && left < params.Timeout {
+			params.Timeout = left
+		}
+	}
+	if err := query(ctx, params); err != nil {
+		return nil, err
+	}
+	close(entries)
+	var found []*ServiceEntry
+	for e := range entries {
+		found = append(found, e)
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("No instances of %s found", service)
+	}
+
+	// Try each instance in turn
+	var errs []string
+	for _, e := range policy(found) {
+		conn, err := dialEntry(ctx, e)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("Failed to dial %s: %s", service, strings.Join(errs, ", "))
+}
+
+// dialEntry is used to connect to an instance, using the protocol of
+// its service and its IPv4 address if it has one
+func dialEntry(ctx context.Context, e *ServiceEntry) (net.Conn, error) {
+	addr := e.DialAddr()
+	if addr == "" {
+		return nil, fmt.Errorf("No address for %s", e.Name)
+	}
+
+	network := "tcp"
+	if e.Protocol == "_udp" {
+		network = "udp"
+	}
+	var d net.Dialer
+	if deadline, ok := ctx.Deadline(); ok {
+		d.Deadline = deadline
+	}
+	return d.Dial(network, addr)
+}
@@ -0,0 +1,147 @@
+package mdns
+
+import (
+	"code.google.com/p/go.net/context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialService_Fallback(t *testing.T) {
+	// The first instance refuses connections
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	refusedPort := refused.Addr().(*net.TCPAddr).Port
+	refused.Close()
+
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		conn, err := list.Accept()
+		if err == nil {
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	query := func(ctx context.Context, params *QueryParam) error {
+		params.Entries <- &ServiceEntry{
+			Name:     "second._http._tcp.local.",
+			AddrV4:   net.IPv4(127, 0, 0, 1),
+			Port:     list.Addr().(*net.TCPAddr).Port,
+			Priority: 10,
+			Protocol: "_tcp",
+		}
+		params.Entries <- &ServiceEntry{
+			Name:     "first._http._tcp.local.",
+			AddrV4:   net.IPv4(127, 0, 0, 1),
+			Port:     refusedPort,
+			Priority: 0,
+			Protocol: "_tcp",
+		}
+		return nil
+	}
+
+	conn, err := dialService(context.Background(), "_http._tcp", PriorityPolicy, query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if port := conn.RemoteAddr().(*net.TCPAddr).Port; port != list.Addr().(*net.TCPAddr).Port {
+		t.Fatalf("bad: %d", port)
+	}
+	<-accepted
+}
+
+func TestDialService_ShortDeadline(t *testing.T) {
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+	go func() {
+		if conn, err := list.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	// The query runs until its timeout, or fails once the context is
+	// done, as QueryContext does
+	var timeout time.Duration
+	query := func(ctx context.Context, params *QueryParam) error {
+		timeout = params.Timeout
+		params.Entries <- &ServiceEntry{
+			Name:     "only._http._tcp.local.",
+			AddrV4:   net.IPv4(127, 0, 0, 1),
+			Port:     list.Addr().(*net.TCPAddr).Port,
+			Protocol: "_tcp",
+		}
+		select {
+		case <-time.After(params.Timeout):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// A deadline shorter than the default timeout leaves time to dial
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	conn, err := dialService(ctx, "_http._tcp", PriorityPolicy, query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if timeout > 100*time.Millisecond {
+		t.Fatalf("bad: %v", timeout)
+	}
+}
+
+func TestPriorityPolicy(t *testing.T) {
+	entries := []*ServiceEntry{
+		&ServiceEntry{Name: "c", Priority: 20, Weight: 5},
+		&ServiceEntry{Name: "b", Priority: 10, Weight: 1},
+		&ServiceEntry{Name: "a", Priority: 10, Weight: 5},
+	}
+	sorted := PriorityPolicy(entries)
+	for i, name := range []string{"a", "b", "c"} {
+		if sorted[i].Name != name {
+			t.Fatalf("bad: %v", sorted)
+		}
+	}
+	if entries[0].Name != "c" {
+		t.Fatalf("input modified: %v", entries)
+	}
+}
+
+func TestDialPolicies(t *testing.T) {
+	entries := []*ServiceEntry{
+		{Name: "a", Priority: 10, Weight: 5},
+		{Name: "b", Priority: 0, Weight: 1},
+		{Name: "c", Priority: 20, Weight: 50},
+	}
+	if e := PriorityPolicy(entries)[0]; e.Name != "b" {
+		t.Fatalf("bad: %v", e)
+	}
+	if e := WeightPolicy(entries)[0]; e.Name != "c" {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// Every entry is kept, in some order
+	seen := make(map[string]bool)
+	for _, e := range RandomPolicy(entries) {
+		seen[e.Name] = true
+	}
+	if len(seen) != len(entries) {
+		t.Fatalf("bad: %v", seen)
+	}
+	if entries[0].Name != "a" {
+		t.Fatalf("policy modified its input")
+	}
+}
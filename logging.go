@@ -0,0 +1,19 @@
+package mdns
+
+import (
+	"log"
+)
+
+// Logger if set receives the log output of the package, which otherwise
+// goes to the standard logger. QueryParam.Logger overrides it for the
+// messages of a single query.
+var Logger *log.Logger
+
+// logf is used to log through Logger, or the standard logger if unset
+func logf(format string, args ...interface{}) {
+	if Logger != nil {
+		Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,33 @@
+package mdns
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var pkg, query bytes.Buffer
+	old := Logger
+	defer func() { Logger = old }()
+	Logger = log.New(&pkg, "", 0)
+
+	// Without a query logger, the package Logger is used
+	state := newQueryState(&QueryParam{}, discardQuery)
+	state.sendError(fmt.Errorf("first failure"))
+	if !strings.Contains(pkg.String(), "first failure") {
+		t.Fatalf("bad: %q", pkg.String())
+	}
+
+	// The query logger overrides it
+	state = newQueryState(&QueryParam{Logger: log.New(&query, "", 0)}, discardQuery)
+	state.sendError(fmt.Errorf("second failure"))
+	if !strings.Contains(query.String(), "second failure") {
+		t.Fatalf("bad: %q", query.String())
+	}
+	if strings.Contains(pkg.String(), "second failure") {
+		t.Fatalf("bad: %q", pkg.String())
+	}
+}
@@ -0,0 +1,30 @@
+package mdns
+
+import (
+	"time"
+)
+
+// MetricsRecorder can be implemented to record metrics about the
+// activity of clients and servers, for example to bridge them to
+// Prometheus without this package depending on it. Methods may be
+// called concurrently.
+type MetricsRecorder interface {
+	// IncQueriesSent is called for each query a client sends
+	IncQueriesSent()
+
+	// IncResponsesReceived is called for each response a client processes
+	IncResponsesReceived()
+
+	// IncSendErrors is called for each follow up query a client fails
+	// to send
+	IncSendErrors()
+
+	// ObserveQueryDuration is called with the duration of each query
+	ObserveQueryDuration(d time.Duration)
+
+	// IncQueriesReceived is called for each query a server receives
+	IncQueriesReceived()
+
+	// IncResponsesSent is called for each response a server sends
+	IncResponsesSent()
+}
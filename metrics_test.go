@@ -0,0 +1,106 @@
+package mdns
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRecorder counts the metric calls it receives
+type fakeRecorder struct {
+	sync.Mutex
+	queriesSent       int
+	responsesReceived int
+	sendErrors        int
+	durations         []time.Duration
+	queriesReceived   int
+	responsesSent     int
+}
+
+func (f *fakeRecorder) IncQueriesSent() {
+	f.Lock()
+	defer f.Unlock()
+	f.queriesSent++
+}
+
+func (f *fakeRecorder) IncResponsesReceived() {
+	f.Lock()
+	defer f.Unlock()
+	f.responsesReceived++
+}
+
+func (f *fakeRecorder) IncSendErrors() {
+	f.Lock()
+	defer f.Unlock()
+	f.sendErrors++
+}
+
+func (f *fakeRecorder) ObserveQueryDuration(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.durations = append(f.durations, d)
+}
+
+func (f *fakeRecorder) IncQueriesReceived() {
+	f.Lock()
+	defer f.Unlock()
+	f.queriesReceived++
+}
+
+func (f *fakeRecorder) IncResponsesSent() {
+	f.Lock()
+	defer f.Unlock()
+	f.responsesSent++
+}
+
+func TestMetrics_Exchange(t *testing.T) {
+	s := makeService(t)
+	s.Service = "_metrics._tcp"
+	s.Init()
+	servMetrics := &fakeRecorder{}
+	serv, err := NewServer(&Config{Zone: s, Metrics: servMetrics})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	clientMetrics := &fakeRecorder{}
+	entries := make(chan *ServiceEntry, 8)
+	params := &QueryParam{
+		Service: "_metrics._tcp",
+		Domain:  "local",
+		Timeout: 50 * time.Millisecond,
+		Entries: entries,
+		Metrics: clientMetrics,
+	}
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) == 0 {
+		t.Fatalf("no entries")
+	}
+
+	clientMetrics.Lock()
+	defer clientMetrics.Unlock()
+	if clientMetrics.queriesSent != 1 {
+		t.Fatalf("bad: %d", clientMetrics.queriesSent)
+	}
+	if clientMetrics.responsesReceived == 0 {
+		t.Fatalf("bad: %d", clientMetrics.responsesReceived)
+	}
+	if len(clientMetrics.durations) != 1 || clientMetrics.durations[0] < params.Timeout {
+		t.Fatalf("bad: %v", clientMetrics.durations)
+	}
+	if clientMetrics.queriesReceived != 0 || clientMetrics.responsesSent != 0 {
+		t.Fatalf("bad: %v", clientMetrics)
+	}
+
+	servMetrics.Lock()
+	defer servMetrics.Unlock()
+	if servMetrics.queriesReceived == 0 || servMetrics.responsesSent == 0 {
+		t.Fatalf("bad: %d %d", servMetrics.queriesReceived, servMetrics.responsesSent)
+	}
+	if servMetrics.queriesSent != 0 || servMetrics.responsesReceived != 0 {
+		t.Fatalf("bad: %d %d", servMetrics.queriesSent, servMetrics.responsesReceived)
+	}
+}
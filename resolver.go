@@ -0,0 +1,199 @@
+package mdns
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// resolverCheckInterval is how often the ResolverCache looks for
+	// services that are due to be refreshed
+	resolverCheckInterval = time.Second
+
+	// resolverRefreshFraction is the fraction of the lifetime of the
+	// cached entries after which they are refreshed in the background
+	resolverRefreshFraction = 0.8
+)
+
+// ResolverCache browses for services and retains the resolved entries
+// until their records expire. Services that are looked up again are
+// refreshed in the background before they expire, so that repeat
+// lookups are answered immediately from the cache.
+type ResolverCache struct {
+	domain  string
+	timeout time.Duration
+
+	// query is used to run each browse, replaced by tests
+	query func(params *QueryParam) error
+
+	services map[string]*resolvedService
+	lock     sync.Mutex
+
+	closed    bool
+	closedCh  chan struct{}
+	closeLock sync.Mutex
+}
+
+// resolvedService holds the cached entries of a service
+type resolvedService struct {
+	entries    []*ServiceEntry
+	fetched    time.Time
+	expires    time.Time
+	lastUsed   time.Time
+	refreshing bool
+}
+
+// NewResolverCache creates a cache that browses the given domain,
+// waiting for at most timeout for each browse
+func NewResolverCache(domain string, timeout time.Duration) *ResolverCache {
+	r := &ResolverCache{
+		domain:   domain,
+		timeout:  timeout,
+		query:    Query,
+		services: make(map[string]*resolvedService),
+		closedCh: make(chan struct{}),
+	}
+	go r.refreshLoop()
+	return r
+}
+
+// Close is used to stop the background refresh
+func (r *ResolverCache) Close() error {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.closedCh)
+	return nil
+}
+
+// Get returns the entries of a service, from the cache if they have
+// not yet expired and otherwise by browsing for the service
+func (r *ResolverCache) Get(service string) ([]*ServiceEntry, error) {
+	now := time.Now()
+	r.lock.Lock()
+	if cached, ok := r.services[service]; ok && now.Before(cached.expires) {
+		cached.lastUsed = now
+		entries := copyEntries(cached.entries)
+		r.lock.Unlock()
+		return entries, nil
+	}
+	r.lock.Unlock()
+
+	entries, err := r.resolve(service)
+	if err != nil {
+		return nil, err
+	}
+	return copyEntries(entries), nil
+}
+
+// resolve is used to browse for a service and cache the results
+func (r *ResolverCache) resolve(service string) ([]*ServiceEntry, error) {
+	ch := make(chan *ServiceEntry, 32)
+	done := make(chan struct{})
+	found := make(map[string]*ServiceEntry)
+	go func() {
+		defer close(done)
+		for e := range ch {
+			found[e.Name] = e
+		}
+	}()
+
+	params := DefaultParams(service)
+	params.Domain = r.domain
+	params.Timeout = r.timeout
+	params.Entries = ch
+	err := r.query(params)
+	close(ch)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+
+	// The entries are fresh until the first of them expires
+	now := time.Now()
+	var entries []*ServiceEntry
+	var expires time.Time
+	for _, e := range found {
+		entries = append(entries, e)
+		if expires.IsZero() || e.ExpiresAt.Before(expires) {
+			expires = e.ExpiresAt
+		}
+	}
+	SortEntries(entries)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(entries) == 0 || !now.Before(expires) {
+		delete(r.services, service)
+		return entries, nil
+	}
+	r.services[service] = &resolvedService{
+		entries:  entries,
+		fetched:  now,
+		expires:  expires,
+		lastUsed: now,
+	}
+	return entries, nil
+}
+
+// refreshLoop is used to refresh services nearing expiry, as long as
+// they have been looked up since they were last resolved
+func (r *ResolverCache) refreshLoop() {
+	ticker := time.NewTicker(resolverCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.refreshDue(time.Now())
+		case <-r.closedCh:
+			return
+		}
+	}
+}
+
+// refreshDue is used to start a refresh of each service that is due,
+// and to drop expired services that are no longer in use
+func (r *ResolverCache) refreshDue(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for service, cached := range r.services {
+		if cached.refreshing {
+			continue
+		}
+		if !cached.lastUsed.After(cached.fetched) {
+			if !now.Before(cached.expires) {
+				delete(r.services, service)
+			}
+			continue
+		}
+		lifetime := cached.expires.Sub(cached.fetched)
+		refreshAt := cached.fetched.Add(time.Duration(float64(lifetime) * resolverRefreshFraction))
+		if now.Before(refreshAt) {
+			continue
+		}
+		cached.refreshing = true
+		go func(service string, cached *resolvedService) {
+			if _, err := r.resolve(service); err != nil {
+				logf("[ERR] mdns: Failed to refresh %s: %v", service, err)
+				r.lock.Lock()
+				cached.refreshing = false
+				r.lock.Unlock()
+			}
+		}(service, cached)
+	}
+}
+
+// copyEntries is used to copy entries so callers may not modify the cache
+func copyEntries(entries []*ServiceEntry) []*ServiceEntry {
+	out := make([]*ServiceEntry, len(entries))
+	for i, e := range entries {
+		dup := *e
+		out[i] = &dup
+	}
+	return out
+}
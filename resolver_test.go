@@ -0,0 +1,51 @@
+package mdns
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func TestResolverCache_Get(t *testing.T) {
+	s := makeService(t)
+	msgCh, send, stop := memoryResponder(s)
+	defer stop()
+
+	r := NewResolverCache("local", 50*time.Millisecond)
+	defer r.Close()
+	queries := 0
+	r.query = func(params *QueryParam) error {
+		queries++
+		return runQuery("_http._tcp.local.", dns.TypeANY, newQueryState(params, send), msgCh)
+	}
+
+	first, err := r.Get("_http._tcp")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(first) != 1 || first[0].Name != s.instanceAddr {
+		t.Fatalf("bad: %v", first)
+	}
+
+	// The second lookup is within the TTL, so is served from the cache
+	second, err := r.Get("_http._tcp")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if queries != 1 {
+		t.Fatalf("bad: %d", queries)
+	}
+	if len(second) != 1 || second[0].Name != first[0].Name || second[0].Port != first[0].Port {
+		t.Fatalf("bad: %v", second)
+	}
+
+	// Callers may not modify the cache
+	second[0].Port = 0
+	third, err := r.Get("_http._tcp")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if third[0].Port != s.Port {
+		t.Fatalf("bad: %v", third[0])
+	}
+}
@@ -1,17 +1,32 @@
 package mdns
 
 import (
+	"code.google.com/p/go.net/ipv4"
+	"code.google.com/p/go.net/ipv6"
 	"fmt"
 	"github.com/miekg/dns"
-	"log"
+	"math/rand"
 	"net"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	ipv4mdns = "224.0.0.251"
 	ipv6mdns = "ff02::fb"
 	mdnsPort = 5353
+
+	// MaxTTLJitter is the largest supported TTLJitter fraction
+	MaxTTLJitter = 0.1
+
+	// maxSourceWindows is the number of tracked sources at which
+	// expired rate limit windows are pruned
+	maxSourceWindows = 1024
+
+	// DefaultMaxResponseSize is the Ethernet MTU less the IPv4 and UDP
+	// headers, the largest response sent without fragmenting
+	DefaultMaxResponseSize = 1472
 )
 
 var (
@@ -34,6 +49,117 @@ type Config struct {
 	// interface. If not provided, the system default multicase interface
 	// is used.
 	Iface *net.Interface
+
+	// Ifaces if provided joins the multicast groups on each of the given
+	// interfaces, and causes queries arriving on any other interface to
+	// be ignored. Announcements and goodbyes are sent on each of them.
+	// It takes precedence over Iface. It relies on the receiving
+	// interface of packets being reported, so on platforms that do not
+	// support this no queries are answered.
+	Ifaces []net.Interface
+
+	// DisableIPv4 and DisableIPv6 prevent the server from listening
+	// and responding on the given address family
+	DisableIPv4 bool
+	DisableIPv6 bool
+
+	// InstanceACL if provided is consulted before answering with the
+	// records of a service instance. If it returns false, the records
+	// of that instance are omitted from the response sent to from.
+	// Announcements, multicast to every host, are checked with a nil
+	// from.
+	InstanceACL func(instance string, from net.Addr) bool
+
+	// DynamicTXT if provided is used to compute TXT content at response
+	// time, overriding the TXT records served by the zone. Its output is
+	// cached for DynamicTXTInterval, which defaults to one second.
+	DynamicTXT         func() []string
+	DynamicTXTInterval time.Duration
+
+	// IsHealthy if provided is consulted when answering or announcing.
+	// While it returns false, TXT records are served with DegradedTXT
+	// instead, such as "status=degraded", so that browsers still see the
+	// service but can tell its state.
+	IsHealthy   func() bool
+	DegradedTXT []string
+
+	// OnConflict if provided is invoked when a response is seen on the
+	// wire that carries a record for one of our names, but with data
+	// that differs from what we serve. This allows the application to
+	// react, for example by renaming the service.
+	OnConflict func(name string, rr dns.RR)
+
+	// TTLJitter if non-zero randomly varies the TTL of each response by
+	// up to this fraction of the record TTL, so that clients caching the
+	// records do not all refresh at the same moment. It is capped at
+	// MaxTTLJitter.
+	TTLJitter float64
+
+	// AnnounceInterval if non-zero causes the server to multicast its
+	// records unsolicited at this interval, so that new hosts learn of
+	// it without querying. The Zone must implement Announcer. A single
+	// packet is sent per interval, so it should not be set too low.
+	AnnounceInterval time.Duration
+
+	// SendAnnouncement causes the server to multicast its records
+	// unsolicited when it starts, repeated with increasing intervals as
+	// recommended by RFC 6762, so that hosts with cached results learn
+	// of it without querying. The Zone must implement Announcer.
+	SendAnnouncement bool
+
+	// SendGoodbye causes the server to multicast its records with a
+	// zero TTL on shutdown, as described in RFC 6762, so that hosts drop
+	// them at once rather than when they expire. The Zone must
+	// implement Announcer.
+	SendGoodbye bool
+
+	// ResponseDelayMin and ResponseDelayMax if set cause responses to be
+	// held for a random delay within the window, as recommended by RFC
+	// 6762 to reduce collisions. Questions from the same querier that
+	// arrive while a response is held are answered in that response.
+	// If ResponseDelayMax is zero, responses are sent immediately.
+	ResponseDelayMin time.Duration
+	ResponseDelayMax time.Duration
+
+	// SourceQuestionLimit if non-zero is the number of questions each
+	// source IP may ask per second. Queries from a source over its budget
+	// are dropped, protecting against a single abusive querier.
+	SourceQuestionLimit int
+
+	// Metrics if provided records the activity of the server
+	Metrics MetricsRecorder
+
+	// DisableCompression sends responses without name compression,
+	// for interoperability with parsers that mishandle it
+	DisableCompression bool
+
+	// MatchSourceSubnet rewrites the addresses of the A and AAAA records
+	// of HostName to the local address on the same subnet as the
+	// querier, for split horizon setups. Records are left as the zone
+	// provides them when no local address shares the querier's subnet.
+	MatchSourceSubnet bool
+
+	// HostName is the name of this host's own A and AAAA records, such
+	// as "myhost.local.", which are the only records MatchSourceSubnet
+	// rewrites. If not set, the instance name of an MDNSService Zone is
+	// used, as it names its address records after the instance.
+	HostName string
+
+	// MinimalResponses leaves the additional section of responses empty,
+	// answering only with the records asked for, such as just the PTR
+	// of a browse. Queriers then follow up for the instance records.
+	// This suits queriers that reject unexpected additional records.
+	MinimalResponses bool
+
+	// MulticastTTL is the IP TTL, or IPv6 hop limit, of the multicast
+	// packets the server sends. Defaults to 255, as recommended by RFC
+	// 6762.
+	MulticastTTL int
+
+	// MaxResponseSize is the largest packet the server sends. Larger
+	// messages are trimmed to fit and flagged as truncated, so queriers
+	// follow up for the rest. Defaults to DefaultMaxResponseSize.
+	MaxResponseSize int
 }
 
 // mDNS server is used to listen for mDNS queries and respond if we
@@ -44,6 +170,24 @@ type Server struct {
 	ipv4List *net.UDPConn
 	ipv6List *net.UDPConn
 
+	dynTXT     []string
+	dynTXTTime time.Time
+	dynTXTLock sync.Mutex
+
+	localAddrs     []net.Addr
+	localAddrsTime time.Time
+	localAddrsLock sync.Mutex
+
+	// unknownIfaceOnce logs the first packet dropped by allowIface for
+	// lack of an interface index
+	unknownIfaceOnce sync.Once
+
+	pending     map[string]*dns.Msg
+	pendingLock sync.Mutex
+
+	sources    map[string]*sourceWindow
+	sourceLock sync.Mutex
+
 	shutdown     bool
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
@@ -51,14 +195,29 @@ type Server struct {
 
 // NewServer is used to create a new mDNS server from a config
 func NewServer(config *Config) (*Server, error) {
+	if config.DisableIPv4 && config.DisableIPv6 {
+		return nil, fmt.Errorf("Cannot disable both IPv4 and IPv6")
+	}
+	if config.AnnounceInterval > 0 || config.SendAnnouncement || config.SendGoodbye {
+		if _, ok := config.Zone.(Announcer); !ok {
+			return nil, fmt.Errorf("Zone must implement Announcer to announce")
+		}
+	}
+
 	// Create the listeners
-	ipv4List, err := net.ListenMulticastUDP("udp4", config.Iface, ipv4Addr)
-	if err != nil {
-		log.Printf("[ERR] mdns: Failed to start IPv4 listener: %v", err)
+	var ipv4List, ipv6List *net.UDPConn
+	var err error
+	if !config.DisableIPv4 {
+		ipv4List, err = listenMulticast("udp4", config, ipv4Addr)
+		if err != nil {
+			logf("[ERR] mdns: Failed to start IPv4 listener: %v", err)
+		}
 	}
-	ipv6List, err := net.ListenMulticastUDP("udp6", config.Iface, ipv6Addr)
-	if err != nil {
-		log.Printf("[ERR] mdns: Failed to start IPv6 listener: %v", err)
+	if !config.DisableIPv6 {
+		ipv6List, err = listenMulticast("udp6", config, ipv6Addr)
+		if err != nil {
+			logf("[ERR] mdns: Failed to start IPv6 listener: %v", err)
+		}
 	}
 
 	// Check if we have any listener
@@ -66,17 +225,61 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, fmt.Errorf("No multicast listeners could be started")
 	}
 
+	// Set the TTL of the multicast packets
+	ttl := config.MulticastTTL
+	if ttl == 0 {
+		ttl = defaultMulticastTTL
+	}
+	if err := setMulticastTTL(ipv4List, ipv6List, ttl); err != nil {
+		logf("[WARN] mdns: Failed to set multicast TTL: %v", err)
+	}
+
 	s := &Server{
 		config:     config,
 		ipv4List:   ipv4List,
 		ipv6List:   ipv6List,
 		shutdownCh: make(chan struct{}),
 	}
-	go s.recv(s.ipv4List)
-	go s.recv(s.ipv6List)
+	if ipv4List != nil {
+		go s.recv(readIPv4(ipv4List))
+	}
+	if ipv6List != nil {
+		go s.recv(readIPv6(ipv6List))
+	}
+	if config.SendAnnouncement {
+		go s.announceStartup()
+	}
+	if config.AnnounceInterval > 0 {
+		go s.announceLoop(config.AnnounceInterval)
+	}
 	return s, nil
 }
 
+// listenMulticast is used to listen on a multicast group, joined on each
+// of the configured interfaces
+func listenMulticast(network string, config *Config, group *net.UDPAddr) (*net.UDPConn, error) {
+	if len(config.Ifaces) == 0 {
+		return net.ListenMulticastUDP(network, config.Iface, group)
+	}
+	conn, err := net.ListenMulticastUDP(network, &config.Ifaces[0], group)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(config.Ifaces); i++ {
+		iface := &config.Ifaces[i]
+		if network == "udp4" {
+			err = ipv4.NewPacketConn(conn).JoinGroup(iface, group)
+		} else {
+			err = ipv6.NewPacketConn(conn).JoinGroup(iface, group)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed to join %v on %s: %v", group.IP, iface.Name, err)
+		}
+	}
+	return conn, nil
+}
+
 // Shutdown is used to shutdown the listener
 func (s *Server) Shutdown() error {
 	s.shutdownLock.Lock()
@@ -88,6 +291,13 @@ func (s *Server) Shutdown() error {
 	s.shutdown = true
 	close(s.shutdownCh)
 
+	// Say goodbye while the sockets are still open
+	if s.config.SendGoodbye {
+		if err := s.goodbye(); err != nil {
+			logf("[WARN] mdns: Failed to send goodbye: %v", err)
+		}
+	}
+
 	if s.ipv4List != nil {
 		s.ipv4List.Close()
 	}
@@ -97,78 +307,793 @@ func (s *Server) Shutdown() error {
 	return nil
 }
 
-// recv is a long running routine to receive packets from an interface
-func (s *Server) recv(c *net.UDPConn) {
-	if c == nil {
-		return
+// readFunc is used to read a packet along with the index of the
+// interface it arrived on, which is zero if unknown
+type readFunc func(buf []byte) (n int, from net.Addr, ifIndex int, err error)
+
+// readIPv4 is used to read from an IPv4 listener, requesting the
+// receiving interface of each packet
+func readIPv4(c *net.UDPConn) readFunc {
+	p := ipv4.NewPacketConn(c)
+	if err := p.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		logf("[WARN] mdns: Failed to enable IPv4 control messages: %v", err)
+	}
+	return func(buf []byte) (int, net.Addr, int, error) {
+		n, cm, from, err := p.ReadFrom(buf)
+		if cm == nil {
+			return n, from, 0, err
+		}
+		return n, from, cm.IfIndex, err
+	}
+}
+
+// readIPv6 is used to read from an IPv6 listener, requesting the
+// receiving interface of each packet
+func readIPv6(c *net.UDPConn) readFunc {
+	p := ipv6.NewPacketConn(c)
+	if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		logf("[WARN] mdns: Failed to enable IPv6 control messages: %v", err)
+	}
+	return func(buf []byte) (int, net.Addr, int, error) {
+		n, cm, from, err := p.ReadFrom(buf)
+		if cm == nil {
+			return n, from, 0, err
+		}
+		return n, from, cm.IfIndex, err
 	}
+}
+
+// recv is a long running routine to receive packets from an interface
+func (s *Server) recv(read readFunc) {
 	buf := make([]byte, 65536)
 	for !s.shutdown {
-		n, from, err := c.ReadFrom(buf)
-		if err != nil {
+		n, from, ifIndex, err := read(buf)
+		if err != nil || !s.allowIface(ifIndex) {
 			continue
 		}
-		if err := s.parsePacket(buf[:n], from); err != nil {
-			log.Printf("[ERR] mdns: Failed to handle query: %v", err)
+		if err := s.parsePacket(buf[:n], from, ifIndex); err != nil {
+			logf("[ERR] mdns: Failed to handle query: %v", err)
 		}
 	}
 }
 
-// parsePacket is used to parse an incoming packet
-func (s *Server) parsePacket(packet []byte, from net.Addr) error {
+// announceLoop is a long running routine to periodically announce
+// the zone records until shutdown
+func (s *Server) announceLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.announce(); err != nil {
+				logf("[ERR] mdns: Failed to announce: %v", err)
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// startupAnnouncements is the number of announcements sent on start
+const startupAnnouncements = 3
+
+// announceBackoff is the delay before the second startup announcement,
+// doubling for each one after
+var announceBackoff = time.Second
+
+// announceStartup is used to send the startup announcements, stopping
+// early on shutdown
+func (s *Server) announceStartup() {
+	wait := announceBackoff
+	for i := 0; i < startupAnnouncements; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(wait):
+				wait *= 2
+			case <-s.shutdownCh:
+				return
+			}
+		}
+		if err := s.announce(); err != nil {
+			logf("[ERR] mdns: Failed to announce: %v", err)
+		}
+	}
+}
+
+// announce is used to multicast the zone records unsolicited
+func (s *Server) announce() error {
+	records := s.announceRecords()
+	if len(records) == 0 {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Authoritative = true
+	msg.Answer = records
+	return s.sendMulticast(msg)
+}
+
+// goodbye is used to multicast the zone records with a zero TTL, telling
+// hosts that have cached them that they are going away
+func (s *Server) goodbye() error {
+	records := s.announceRecords()
+	if len(records) == 0 {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Authoritative = true
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		msg.Answer = append(msg.Answer, rr)
+	}
+	return s.sendMulticast(msg)
+}
+
+// announceRecords is used to get the zone records to announce, served
+// the same way as those answering a query, so that announcements agree
+// with the answers
+func (s *Server) announceRecords() []dns.RR {
+	zone, ok := s.config.Zone.(Announcer)
+	if !ok {
+		return nil
+	}
+	return s.serveRecords(zone.AnnounceRecords(), nil)
+}
+
+// sendMulticast is used to send a message to the multicast groups, on
+// each of the configured interfaces
+func (s *Server) sendMulticast(msg *dns.Msg) error {
+	buf, err := s.pack(msg)
+	if err != nil {
+		return err
+	}
+	if s.ipv4List != nil {
+		if err := s.multicastOn(s.ipv4List, buf, ipv4Addr); err != nil {
+			return err
+		}
+	}
+	if s.ipv6List != nil {
+		if err := s.multicastOn(s.ipv6List, buf, ipv6Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// multicastWrite is used to send a packet out of the interface with the
+// given index, and may be replaced for testing
+var multicastWrite = writeFrom
+
+// multicastOn is used to send a packet to a multicast group, out of
+// every interface in Ifaces if set, trying them all before returning
+// the first error
+func (s *Server) multicastOn(conn *net.UDPConn, buf []byte, group *net.UDPAddr) error {
+	if len(s.config.Ifaces) == 0 {
+		_, err := conn.WriteToUDP(buf, group)
+		return err
+	}
+	var first error
+	for _, iface := range s.config.Ifaces {
+		if err := multicastWrite(conn, buf, group, iface.Index); err != nil && first == nil {
+			first = fmt.Errorf("Failed to send on %s: %v", iface.Name, err)
+		}
+	}
+	return first
+}
+
+// allowIface is used to check if packets arriving on the interface
+// with the given index should be handled. When Ifaces is set, packets
+// from an unknown interface, as on platforms without control messages,
+// are dropped, as they cannot be checked.
+func (s *Server) allowIface(ifIndex int) bool {
+	if len(s.config.Ifaces) == 0 {
+		return true
+	}
+	if ifIndex == 0 {
+		s.unknownIfaceOnce.Do(func() {
+			logf("[WARN] mdns: Dropping packets from an unknown interface, as Ifaces is set")
+		})
+		return false
+	}
+	for _, iface := range s.config.Ifaces {
+		if iface.Index == ifIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePacket is used to parse an incoming packet, received on the
+// interface with the given index
+func (s *Server) parsePacket(packet []byte, from net.Addr, ifIndex int) error {
 	var msg dns.Msg
-	if err := msg.Unpack(packet); err != nil {
-		log.Printf("[ERR] mdns: Failed to unpack packet: %v", err)
+	if err := msg.Unpack(packet); err != nil && err != dns.ErrTruncated {
+		logf("[ERR] mdns: Failed to unpack packet: %v", err)
 		return err
 	}
-	return s.handleQuery(&msg, from)
+	if msg.Response {
+		return s.handleResponse(&msg, from)
+	}
+	return s.handleQuery(&msg, from, ifIndex)
+}
+
+// handleResponse is used to watch responses from other hosts for
+// records conflicting with our own
+func (s *Server) handleResponse(resp *dns.Msg, from net.Addr) error {
+	if s.config.Zone == nil || s.config.OnConflict == nil {
+		return nil
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Extra} {
+		for _, rr := range section {
+			if s.conflicts(rr) {
+				s.config.OnConflict(rr.Header().Name, rr)
+			}
+		}
+	}
+	return nil
+}
+
+// conflicts is used to check if a record is for one of our unique
+// names, but differs from every record we serve for it
+func (s *Server) conflicts(rr dns.RR) bool {
+	hdr := rr.Header()
+	switch hdr.Rrtype {
+	case dns.TypeSRV, dns.TypeTXT, dns.TypeA, dns.TypeAAAA:
+	default:
+		// Shared records such as PTR cannot conflict
+		return false
+	}
+
+	ours := s.config.Zone.Records(dns.Question{
+		Name:   hdr.Name,
+		Qtype:  hdr.Rrtype,
+		Qclass: dns.ClassINET,
+	})
+	found := false
+	for _, own := range ours {
+		if own.Header().Rrtype != hdr.Rrtype || own.Header().Name != hdr.Name {
+			continue
+		}
+		if rdataEqual(own, rr) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// rdataEqual is used to compare the data of two records of the same type
+func rdataEqual(a, b dns.RR) bool {
+	switch ra := a.(type) {
+	case *dns.SRV:
+		rb := b.(*dns.SRV)
+		return ra.Port == rb.Port && ra.Target == rb.Target &&
+			ra.Priority == rb.Priority && ra.Weight == rb.Weight
+	case *dns.TXT:
+		rb := b.(*dns.TXT)
+		return strings.Join(ra.Txt, "\x00") == strings.Join(rb.Txt, "\x00")
+	case *dns.A:
+		return net.IP(ra.A).Equal(net.IP(b.(*dns.A).A))
+	case *dns.AAAA:
+		return net.IP(ra.AAAA).Equal(net.IP(b.(*dns.AAAA).AAAA))
+	}
+	return false
 }
 
 // handleQuery is used to handle an incoming query
-func (s *Server) handleQuery(query *dns.Msg, from net.Addr) error {
+func (s *Server) handleQuery(query *dns.Msg, from net.Addr, ifIndex int) error {
+	if s.config.Metrics != nil {
+		s.config.Metrics.IncQueriesReceived()
+	}
+
+	// Check if there is an answer
+	resp := s.respond(query, from)
+	if resp == nil {
+		return nil
+	}
+	if s.config.ResponseDelayMax > 0 {
+		s.delayResponse(resp, from, ifIndex)
+		return nil
+	}
+	return s.sendResponse(resp, from, ifIndex)
+}
+
+// respond is used to build the response to a query, returning nil if
+// there is nothing to answer
+func (s *Server) respond(query *dns.Msg, from net.Addr) *dns.Msg {
+	// Drop the query if the source is over budget
+	if !s.allowSource(from, len(query.Question)) {
+		return nil
+	}
+
 	var resp dns.Msg
 	resp.SetReply(query)
 
-	// Handle each question
-	if len(query.Question) > 0 {
-		if err := s.handleQuestion(query.Question[0], &resp); err != nil {
-			log.Printf("[ERR] mdns: failed to handle question %v: %v",
-				query.Question[0], err)
+	// Handle each question, aggregating the answers in one response
+	for _, q := range query.Question {
+		if err := s.handleQuestion(q, &resp, from); err != nil {
+			logf("[ERR] mdns: failed to handle question %v: %v",
+				q, err)
 		}
 	}
 
-	// Check if there is an answer
-	if len(resp.Answer) > 0 {
-		return s.sendResponse(&resp, from)
+	if len(resp.Answer) == 0 {
+		return nil
 	}
-	return nil
+	return &resp
+}
+
+// sourceWindow counts the questions from a source in a one second window
+type sourceWindow struct {
+	start     time.Time
+	questions int
+}
+
+// allowSource is used to charge questions against the per-second budget
+// of the source IP, returning false if the budget is exceeded
+func (s *Server) allowSource(from net.Addr, questions int) bool {
+	limit := s.config.SourceQuestionLimit
+	if limit <= 0 {
+		return true
+	}
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+
+	s.sourceLock.Lock()
+	defer s.sourceLock.Unlock()
+
+	now := time.Now()
+	if s.sources == nil {
+		s.sources = make(map[string]*sourceWindow)
+	}
+
+	// Prune expired windows so the map stays bounded
+	if len(s.sources) >= maxSourceWindows {
+		for key, w := range s.sources {
+			if now.Sub(w.start) >= time.Second {
+				delete(s.sources, key)
+			}
+		}
+	}
+
+	key := addr.IP.String()
+	w, ok := s.sources[key]
+	if !ok || now.Sub(w.start) >= time.Second {
+		w = &sourceWindow{start: now}
+		s.sources[key] = w
+	}
+	w.questions += questions
+	if w.questions > limit {
+		if w.questions-questions <= limit {
+			logf("[WARN] mdns: Source %v exceeded %d questions per second, dropping",
+				addr.IP, limit)
+		}
+		return false
+	}
+	return true
+}
+
+// delayResponse is used to hold a response for a random delay, merging
+// in the answers to any further questions from the same querier
+func (s *Server) delayResponse(resp *dns.Msg, from net.Addr, ifIndex int) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	key := from.String()
+	if pending, ok := s.pending[key]; ok {
+		pending.Answer = mergeRecords(pending.Answer, resp.Answer)
+		pending.Extra = mergeRecords(pending.Extra, resp.Extra)
+		return
+	}
+	if s.pending == nil {
+		s.pending = make(map[string]*dns.Msg)
+	}
+	s.pending[key] = resp
+
+	// Pick a delay within the window
+	delay := s.config.ResponseDelayMin
+	if spread := s.config.ResponseDelayMax - delay; spread > 0 {
+		delay += time.Duration(rand.Int63n(int64(spread)))
+	}
+	time.AfterFunc(delay, func() {
+		s.flushResponse(key, from, ifIndex)
+	})
+}
+
+// flushResponse is used to send a held response
+func (s *Server) flushResponse(key string, from net.Addr, ifIndex int) {
+	s.pendingLock.Lock()
+	resp := s.pending[key]
+	delete(s.pending, key)
+	s.pendingLock.Unlock()
+
+	select {
+	case <-s.shutdownCh:
+		return
+	default:
+	}
+	if err := s.sendResponse(resp, from, ifIndex); err != nil {
+		logf("[ERR] mdns: Failed to send delayed response: %v", err)
+	}
+}
+
+// mergeRecords is used to append records that are not already present
+func mergeRecords(existing, add []dns.RR) []dns.RR {
+	for _, rr := range add {
+		dup := false
+		for _, have := range existing {
+			if have.String() == rr.String() {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			existing = append(existing, rr)
+		}
+	}
+	return existing
 }
 
 // handleQuestion is used to handle an incoming question
-func (s *Server) handleQuestion(q dns.Question, resp *dns.Msg) error {
+func (s *Server) handleQuestion(q dns.Question, resp *dns.Msg, from net.Addr) error {
 	// Bail if we have no zone
 	if s.config.Zone == nil {
 		return nil
 	}
 
 	// Add all the query answers
-	records := s.config.Zone.Records(q)
-	resp.Answer = append(resp.Answer, records...)
+	records := s.serveRecords(s.config.Zone.Records(q), from)
+
+	// Records of the question name and type are answers, while the rest,
+	// such as the instance records for a browse or the addresses for an
+	// instance SRV question, go in the additional section
+	var answer, extra []dns.RR
+	for _, rr := range records {
+		hdr := rr.Header()
+		if hdr.Name == q.Name && (q.Qtype == dns.TypeANY || hdr.Rrtype == q.Qtype) {
+			answer = append(answer, rr)
+		} else {
+			extra = append(extra, rr)
+		}
+	}
+
+	// Skip records already added for an earlier question
+	resp.Answer = mergeRecords(resp.Answer, answer)
+	if !s.config.MinimalResponses {
+		resp.Extra = mergeRecords(resp.Extra, extra)
+	}
 	return nil
 }
 
-// sendResponse is used to send a response packet
-func (s *Server) sendResponse(resp *dns.Msg, from net.Addr) error {
-	buf, err := resp.Pack()
+// serveRecords is used to filter and rewrite zone records as configured
+// before they are sent to from, which is nil for multicast announcements
+func (s *Server) serveRecords(records []dns.RR, from net.Addr) []dns.RR {
+	if s.config.InstanceACL != nil {
+		records = s.filterInstances(records, from)
+	}
+	if s.config.IsHealthy != nil && !s.config.IsHealthy() {
+		records = replaceTXT(records, s.degradedTXT)
+	} else if s.config.DynamicTXT != nil {
+		records = replaceTXT(records, s.dynamicTXT)
+	}
+	records = placeholderTXT(records)
+	if s.config.TTLJitter > 0 {
+		records = jitterTTL(records, s.config.TTLJitter)
+	}
+	if s.config.MatchSourceSubnet {
+		records = s.matchSubnet(records, from)
+	}
+	return records
+}
+
+// filterInstances is used to remove the records of any instance
+// that the InstanceACL denies to the querier
+func (s *Server) filterInstances(records []dns.RR, from net.Addr) []dns.RR {
+	// Evaluate the ACL for every instance referenced
+	allowed := make(map[string]bool)
+	check := func(instance string) {
+		if _, ok := allowed[instance]; !ok {
+			allowed[instance] = s.config.InstanceACL(instance, from)
+		}
+	}
+	for _, rec := range records {
+		switch rr := rec.(type) {
+		case *dns.PTR:
+			check(rr.Ptr)
+		case *dns.SRV, *dns.TXT:
+			check(rr.Header().Name)
+		}
+	}
+
+	// Drop pointers to denied instances, and records they own
+	var out []dns.RR
+	for _, rec := range records {
+		if ptr, ok := rec.(*dns.PTR); ok && !allowed[ptr.Ptr] {
+			continue
+		}
+		if ok, seen := allowed[rec.Header().Name]; seen && !ok {
+			continue
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// replaceTXT is used to substitute the strings returned by txt into any
+// TXT records. The records are copied, as the zone may reuse them.
+func replaceTXT(records []dns.RR, txt func() []string) []dns.RR {
+	var strs []string
+	for i, rec := range records {
+		rr, ok := rec.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		if strs == nil {
+			strs = txt()
+		}
+		records[i] = &dns.TXT{Hdr: rr.Hdr, Txt: strs}
+	}
+	return records
+}
+
+// degradedTXT is used to get the TXT strings served while unhealthy
+func (s *Server) degradedTXT() []string {
+	return s.config.DegradedTXT
+}
+
+// localAddrs is used to list the addresses of the server's interface,
+// or of the host if it has none, and may be replaced for testing
+var localAddrs = func(iface *net.Interface) ([]net.Addr, error) {
+	if iface != nil {
+		return iface.Addrs()
+	}
+	return net.InterfaceAddrs()
+}
+
+// matchSubnet is used to replace the addresses of the host's own A and
+// AAAA records with the local address on the same subnet as the querier,
+// if any. Records left with the same address are then dropped.
+func (s *Server) matchSubnet(records []dns.RR, from net.Addr) []dns.RR {
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return records
+	}
+	host := s.hostName()
+	if host == "" {
+		return records
+	}
+	local := s.subnetAddr(addr.IP)
+	if local == nil {
+		return records
+	}
+
+	var out []dns.RR
+	for _, rec := range records {
+		if strings.EqualFold(rec.Header().Name, host) {
+			switch rr := rec.(type) {
+			case *dns.A:
+				if ip4 := local.To4(); ip4 != nil {
+					rec = &dns.A{Hdr: rr.Hdr, A: ip4}
+				}
+			case *dns.AAAA:
+				if local.To4() == nil {
+					rec = &dns.AAAA{Hdr: rr.Hdr, AAAA: local}
+				}
+			}
+		}
+		if !containsRecord(out, rec) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// hostName is used to get the name of the host's own address records
+func (s *Server) hostName() string {
+	if s.config.HostName != "" {
+		return s.config.HostName
+	}
+	if m, ok := s.config.Zone.(*MDNSService); ok {
+		return m.instanceAddr
+	}
+	return ""
+}
+
+// containsRecord is used to check if records holds one with the same
+// name, type and data as rr
+func containsRecord(records []dns.RR, rr dns.RR) bool {
+	hdr := rr.Header()
+	for _, have := range records {
+		h := have.Header()
+		if h.Rrtype == hdr.Rrtype && strings.EqualFold(h.Name, hdr.Name) && rdataEqual(have, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// localAddrsInterval is how long the listed local addresses are reused
+const localAddrsInterval = 10 * time.Second
+
+// subnetAddr is used to find the local address on the same subnet as
+// the given address, returning nil if there is none. The local
+// addresses are listed at most once per localAddrsInterval.
+func (s *Server) subnetAddr(ip net.IP) net.IP {
+	s.localAddrsLock.Lock()
+	if s.localAddrsTime.IsZero() || time.Since(s.localAddrsTime) >= localAddrsInterval {
+		addrs, err := localAddrs(s.config.Iface)
+		if err != nil {
+			s.localAddrsLock.Unlock()
+			logf("[ERR] mdns: Failed to list local addresses: %v", err)
+			return nil
+		}
+		s.localAddrs = addrs
+		s.localAddrsTime = time.Now()
+	}
+	addrs := s.localAddrs
+	s.localAddrsLock.Unlock()
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(ip) {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+// placeholderTXT is used to give TXT records without any strings the
+// single empty string required by DNS-SD, so that queriers can tell a
+// service without metadata from one that is not yet resolved
+func placeholderTXT(records []dns.RR) []dns.RR {
+	for i, rec := range records {
+		if rr, ok := rec.(*dns.TXT); ok && len(rr.Txt) == 0 {
+			records[i] = &dns.TXT{Hdr: rr.Hdr, Txt: []string{""}}
+		}
+	}
+	return records
+}
+
+// dynamicTXT is used to get the dynamic TXT content, calling DynamicTXT
+// at most once per DynamicTXTInterval
+func (s *Server) dynamicTXT() []string {
+	s.dynTXTLock.Lock()
+	defer s.dynTXTLock.Unlock()
+
+	interval := s.config.DynamicTXTInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	if s.dynTXT == nil || time.Since(s.dynTXTTime) >= interval {
+		s.dynTXT = s.config.DynamicTXT()
+		s.dynTXTTime = time.Now()
+	}
+	return s.dynTXT
+}
+
+// jitterTTL is used to randomly vary the TTLs of copies of the records
+// by up to the given fraction
+func jitterTTL(records []dns.RR, jitter float64) []dns.RR {
+	if jitter > MaxTTLJitter {
+		jitter = MaxTTLJitter
+	}
+	// A single offset keeps the TTLs of the response consistent
+	offset := (rand.Float64()*2 - 1) * jitter
+	for i, rr := range records {
+		ttl := rr.Header().Ttl
+		if ttl == 0 {
+			continue
+		}
+		rr = dns.Copy(rr)
+		varied := int64(float64(ttl) * (1 + offset))
+		if varied < 1 {
+			varied = 1
+		}
+		rr.Header().Ttl = uint32(varied)
+		records[i] = rr
+	}
+	return records
+}
+
+// pack is used to serialize an outgoing message, trimming records from
+// the message until it fits in the maximum response size
+func (s *Server) pack(msg *dns.Msg) ([]byte, error) {
+	msg.Compress = !s.config.DisableCompression
+	max := s.config.MaxResponseSize
+	if max <= 0 {
+		max = DefaultMaxResponseSize
+	}
+
+	buf, err := msg.Pack()
+	for err == nil && len(buf) > max {
+		// Trim additional records first, as they are only hints
+		if n := len(msg.Extra); n > 0 {
+			msg.Extra = msg.Extra[:n-1]
+		} else if n := len(msg.Answer); n > 0 {
+			msg.Answer = msg.Answer[:n-1]
+		} else {
+			return nil, fmt.Errorf("Message does not fit in %d bytes", max)
+		}
+		msg.Truncated = true
+		buf, err = msg.Pack()
+	}
+	return buf, err
+}
+
+// sendResponse is used to send a response packet. If the index of the
+// interface the query arrived on is known, the response is sent from
+// that interface, so that multi-homed hosts answer from the address
+// the querier reached.
+func (s *Server) sendResponse(resp *dns.Msg, from net.Addr, ifIndex int) error {
+	buf, err := s.pack(resp)
 	if err != nil {
 		return err
 	}
 	addr := from.(*net.UDPAddr)
+	conn := s.ipv6List
 	if addr.IP.To4() != nil {
-		_, err = s.ipv4List.WriteToUDP(buf, addr)
-		return err
+		conn = s.ipv4List
+	}
+	if conn == nil {
+		return fmt.Errorf("No listener for address family of %v", addr)
+	}
+	if ifIndex == 0 {
+		_, err = conn.WriteToUDP(buf, addr)
 	} else {
-		_, err = s.ipv6List.WriteToUDP(buf, addr)
+		err = writeFrom(conn, buf, addr, ifIndex)
+	}
+	if err != nil {
 		return err
 	}
+	if s.config.Metrics != nil {
+		s.config.Metrics.IncResponsesSent()
+	}
+	return nil
+}
+
+// writeFrom is used to send a packet out of the interface with the
+// given index, from its address best suited to reach addr
+func writeFrom(conn *net.UDPConn, buf []byte, addr *net.UDPAddr, ifIndex int) error {
+	src := ifaceAddr(ifIndex, addr.IP)
+	if addr.IP.To4() != nil {
+		cm := &ipv4.ControlMessage{IfIndex: ifIndex, Src: src}
+		_, err := ipv4.NewPacketConn(conn).WriteTo(buf, cm, addr)
+		return err
+	}
+	cm := &ipv6.ControlMessage{IfIndex: ifIndex, Src: src}
+	_, err := ipv6.NewPacketConn(conn).WriteTo(buf, cm, addr)
+	return err
+}
+
+// ifaceAddr is used to pick the address of the interface with the
+// given index to answer ip from, preferring one on the same subnet.
+// It returns nil if the interface has no address of the family.
+func ifaceAddr(ifIndex int, ip net.IP) net.IP {
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return nil
+	}
+	addrs, err := localAddrs(iface)
+	if err != nil {
+		return nil
+	}
+	var first net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() == nil) != (ip.To4() == nil) {
+			continue
+		}
+		if ipnet.Contains(ip) {
+			return ipnet.IP
+		}
+		if first == nil {
+			first = ipnet.IP
+		}
+	}
+	return first
 }
@@ -2,6 +2,11 @@ package mdns
 
 import (
 	"bytes"
+	"code.google.com/p/go.net/ipv4"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -63,3 +68,1043 @@ func TestServer_Lookup(t *testing.T) {
 		t.Fatalf("record not found")
 	}
 }
+
+func TestServer_InstanceACL(t *testing.T) {
+	s := makeService(t)
+	denied := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}
+	allowed := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+	serv := &Server{
+		config: &Config{
+			Zone: s,
+			InstanceACL: func(instance string, from net.Addr) bool {
+				if instance != s.instanceAddr {
+					t.Fatalf("bad: %v", instance)
+				}
+				return from.String() != denied.String()
+			},
+		},
+	}
+
+	q := dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	}
+	var resp dns.Msg
+	if err := serv.handleQuestion(q, &resp, denied); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(resp.Answer) != 0 || len(resp.Extra) != 0 {
+		t.Fatalf("bad: %v", resp)
+	}
+
+	resp = dns.Msg{}
+	if err := serv.handleQuestion(q, &resp, allowed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(resp.Answer) != 1 || len(resp.Extra) != 3 {
+		t.Fatalf("bad: %v", resp)
+	}
+}
+
+func TestServer_DisableFamily(t *testing.T) {
+	s := makeService(t)
+	serv, err := NewServer(&Config{Zone: s, DisableIPv6: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+	if serv.ipv4List == nil || serv.ipv6List != nil {
+		t.Fatalf("bad: %v %v", serv.ipv4List, serv.ipv6List)
+	}
+	if err := serv.sendResponse(new(dns.Msg), &net.UDPAddr{IP: net.ParseIP("ff02::fb")}, 0); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	serv6, err := NewServer(&Config{Zone: s, DisableIPv4: true})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv6.Shutdown()
+	if serv6.ipv4List != nil || serv6.ipv6List == nil {
+		t.Fatalf("bad: %v %v", serv6.ipv4List, serv6.ipv6List)
+	}
+
+	if _, err := NewServer(&Config{Zone: s, DisableIPv4: true, DisableIPv6: true}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestServer_DynamicTXT(t *testing.T) {
+	s := makeService(t)
+	calls := 0
+	serv := &Server{
+		config: &Config{
+			Zone: s,
+			DynamicTXT: func() []string {
+				calls++
+				return []string{fmt.Sprintf("load=%d", calls)}
+			},
+			DynamicTXTInterval: 20 * time.Millisecond,
+		},
+	}
+	q := dns.Question{
+		Name:  s.instanceAddr,
+		Qtype: dns.TypeTXT,
+	}
+	txt := func() string {
+		var resp dns.Msg
+		if err := serv.handleQuestion(q, &resp, nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("bad: %v", resp.Answer)
+		}
+		return resp.Answer[0].(*dns.TXT).Txt[0]
+	}
+
+	if v := txt(); v != "load=1" {
+		t.Fatalf("bad: %v", v)
+	}
+
+	// Cached until the interval passes
+	if v := txt(); v != "load=1" {
+		t.Fatalf("bad: %v", v)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if v := txt(); v != "load=2" {
+		t.Fatalf("bad: %v", v)
+	}
+}
+
+func TestServer_DegradedTXT(t *testing.T) {
+	s := makeService(t)
+	healthy := true
+	serv := &Server{
+		config: &Config{
+			Zone:        s,
+			IsHealthy:   func() bool { return healthy },
+			DegradedTXT: []string{"status=degraded"},
+		},
+	}
+	q := dns.Question{
+		Name:  s.instanceAddr,
+		Qtype: dns.TypeTXT,
+	}
+	txt := func() string {
+		var resp dns.Msg
+		if err := serv.handleQuestion(q, &resp, nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("bad: %v", resp.Answer)
+		}
+		return resp.Answer[0].(*dns.TXT).Txt[0]
+	}
+
+	if v := txt(); v != s.Info {
+		t.Fatalf("bad: %v", v)
+	}
+	healthy = false
+	if v := txt(); v != "status=degraded" {
+		t.Fatalf("bad: %v", v)
+	}
+	healthy = true
+	if v := txt(); v != s.Info {
+		t.Fatalf("bad: %v", v)
+	}
+}
+
+func TestServer_OnConflict(t *testing.T) {
+	s := makeService(t)
+	var conflicts []dns.RR
+	serv := &Server{
+		config: &Config{
+			Zone: s,
+			OnConflict: func(name string, rr dns.RR) {
+				if name != s.instanceAddr {
+					t.Fatalf("bad: %v", name)
+				}
+				conflicts = append(conflicts, rr)
+			},
+		},
+	}
+
+	// Our own announcement is not a conflict
+	own := s.Records(dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	})
+	resp := &dns.Msg{Answer: own}
+	resp.Response = true
+	if err := serv.handleResponse(resp, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(conflicts) != 0 {
+		t.Fatalf("bad: %v", conflicts)
+	}
+
+	// Another host claiming our instance name is
+	srv := &dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   s.instanceAddr,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+		},
+		Priority: 10,
+		Weight:   1,
+		Port:     9999,
+		Target:   s.instanceAddr,
+	}
+	resp = &dns.Msg{Answer: []dns.RR{own[0], srv}}
+	resp.Response = true
+	if err := serv.handleResponse(resp, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(conflicts) != 1 || conflicts[0] != srv {
+		t.Fatalf("bad: %v", conflicts)
+	}
+}
+
+func TestServer_MinimalResponses(t *testing.T) {
+	s := makeService(t)
+	serv := &Server{config: &Config{Zone: s, MinimalResponses: true}}
+
+	q := dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	}
+	var resp dns.Msg
+	if err := serv.handleQuestion(q, &resp, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("bad: %v", resp.Answer)
+	}
+	if _, ok := resp.Answer[0].(*dns.PTR); !ok {
+		t.Fatalf("bad: %v", resp.Answer[0])
+	}
+	if len(resp.Extra) != 0 {
+		t.Fatalf("bad: %v", resp.Extra)
+	}
+}
+
+func TestServer_BrowseAdditional(t *testing.T) {
+	s := makeService(t)
+	serv := &Server{config: &Config{Zone: s}}
+
+	q := dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	}
+	var resp dns.Msg
+	if err := serv.handleQuestion(q, &resp, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("bad: %v", resp.Answer)
+	}
+	if _, ok := resp.Answer[0].(*dns.PTR); !ok {
+		t.Fatalf("bad: %v", resp.Answer[0])
+	}
+	if len(resp.Extra) != 3 {
+		t.Fatalf("bad: %v", resp.Extra)
+	}
+
+	// The client should resolve the entry without any follow ups
+	queries := 0
+	send := func(q *dns.Msg) error {
+		queries++
+		return nil
+	}
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, send)
+	state.handleResponse(&resp, nil)
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if queries != 0 {
+		t.Fatalf("bad: %d", queries)
+	}
+	e := <-entries
+	if e.Name != s.instanceAddr || e.Port != s.Port || e.Info != s.Info {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+// staticZone serves a fixed set of records for any question
+type staticZone []dns.RR
+
+func (s staticZone) Records(q dns.Question) []dns.RR {
+	out := make([]dns.RR, len(s))
+	copy(out, s)
+	return out
+}
+
+func TestServer_TTLJitter(t *testing.T) {
+	s := makeService(t)
+	s.TTL = 1000
+	serv := &Server{
+		config: &Config{
+			Zone:      s,
+			TTLJitter: 0.05,
+		},
+	}
+
+	// The records served by the zone are varied
+	q := dns.Question{
+		Name:  s.instanceAddr,
+		Qtype: dns.TypeTXT,
+	}
+	seen := make(map[uint32]struct{})
+	for i := 0; i < 50; i++ {
+		var resp dns.Msg
+		if err := serv.handleQuestion(q, &resp, nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("bad: %v", resp.Answer)
+		}
+		ttl := resp.Answer[0].Header().Ttl
+		if ttl < 950 || ttl > 1050 {
+			t.Fatalf("bad: %d", ttl)
+		}
+		seen[ttl] = struct{}{}
+	}
+	if len(seen) < 2 {
+		t.Fatalf("no jitter: %v", seen)
+	}
+}
+
+func TestServer_AnnounceInterval(t *testing.T) {
+	s := makeService(t)
+	s.Service = "_announce._tcp"
+	s.Init()
+
+	// Listen on the group for announcements
+	list, err := net.ListenMulticastUDP("udp4", nil, ipv4Addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+
+	if _, err := NewServer(&Config{Zone: staticZone{}, AnnounceInterval: time.Second}); err == nil {
+		t.Fatalf("expected error")
+	}
+	serv, err := NewServer(&Config{
+		Zone:             s,
+		DisableIPv6:      true,
+		AnnounceInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	// Count the announcements seen in a window
+	var times []time.Time
+	buf := make([]byte, 65536)
+	deadline := time.Now().Add(330 * time.Millisecond)
+	list.SetReadDeadline(deadline)
+	for time.Now().Before(deadline) {
+		n, err := list.Read(buf)
+		if err != nil {
+			break
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+		if len(msg.Answer) > 0 && msg.Answer[0].Header().Name == "_announce._tcp.local." {
+			times = append(times, time.Now())
+		}
+	}
+	if len(times) < 4 || len(times) > 8 {
+		t.Fatalf("bad: %d", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < 25*time.Millisecond {
+			t.Fatalf("announced too soon: %v", gap)
+		}
+	}
+}
+
+func TestServer_SendAnnouncement(t *testing.T) {
+	old := announceBackoff
+	defer func() { announceBackoff = old }()
+	announceBackoff = 50 * time.Millisecond
+
+	s := makeService(t)
+	s.Service = "_startup._tcp"
+	s.Init()
+
+	// Listen on the group for announcements
+	list, err := net.ListenMulticastUDP("udp4", nil, ipv4Addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+
+	if _, err := NewServer(&Config{Zone: staticZone{}, SendAnnouncement: true}); err == nil {
+		t.Fatalf("expected error")
+	}
+	serv, err := NewServer(&Config{
+		Zone:             s,
+		DisableIPv6:      true,
+		SendAnnouncement: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	// Expect announcements at 0, 50 and 150ms, and no more
+	var times []time.Time
+	buf := make([]byte, 65536)
+	deadline := time.Now().Add(400 * time.Millisecond)
+	list.SetReadDeadline(deadline)
+	for time.Now().Before(deadline) {
+		n, err := list.Read(buf)
+		if err != nil {
+			break
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+		if len(msg.Answer) > 0 && msg.Answer[0].Header().Name == "_startup._tcp.local." {
+			times = append(times, time.Now())
+		}
+	}
+	if len(times) != startupAnnouncements {
+		t.Fatalf("bad: %d", len(times))
+	}
+	if gap := times[2].Sub(times[1]); gap < times[1].Sub(times[0]) {
+		t.Fatalf("interval did not increase: %v", gap)
+	}
+}
+
+func TestServer_AnnounceRecords(t *testing.T) {
+	s := makeService(t)
+	serv := &Server{config: &Config{
+		Zone: s,
+		InstanceACL: func(instance string, from net.Addr) bool {
+			return from == nil
+		},
+		DynamicTXT: func() []string {
+			return []string{"load=low"}
+		},
+	}}
+
+	// Announcements carry the same TXT as answers
+	records := serv.announceRecords()
+	var found bool
+	for _, rr := range records {
+		if txt, ok := rr.(*dns.TXT); ok {
+			found = true
+			if len(txt.Txt) != 1 || txt.Txt[0] != "load=low" {
+				t.Fatalf("bad: %v", txt)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("bad: %v", records)
+	}
+
+	// Instances denied by the ACL are not announced
+	serv.config.InstanceACL = func(instance string, from net.Addr) bool {
+		return false
+	}
+	if records := serv.announceRecords(); len(records) != 0 {
+		t.Fatalf("bad: %v", records)
+	}
+}
+
+func TestServer_AnnounceDegradedTXT(t *testing.T) {
+	s := makeService(t)
+	healthy := true
+	serv := &Server{config: &Config{
+		Zone:        s,
+		IsHealthy:   func() bool { return healthy },
+		DegradedTXT: []string{"status=degraded"},
+	}}
+
+	txt := func() []string {
+		for _, rr := range serv.announceRecords() {
+			if txt, ok := rr.(*dns.TXT); ok {
+				return txt.Txt
+			}
+		}
+		t.Fatalf("no TXT announced")
+		return nil
+	}
+	if strs := txt(); len(strs) != 1 || strs[0] != s.Info {
+		t.Fatalf("bad: %v", strs)
+	}
+
+	// An unhealthy server announces the degraded TXT
+	healthy = false
+	if strs := txt(); len(strs) != 1 || strs[0] != "status=degraded" {
+		t.Fatalf("bad: %v", strs)
+	}
+}
+
+func TestServer_SendGoodbye(t *testing.T) {
+	s := makeService(t)
+	s.Service = "_goodbye._tcp"
+	s.Init()
+
+	// Listen on the group for the goodbye
+	list, err := net.ListenMulticastUDP("udp4", nil, ipv4Addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer list.Close()
+
+	serv, err := NewServer(&Config{
+		Zone:        s,
+		DisableIPv6: true,
+		SendGoodbye: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := serv.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A second shutdown has no sockets to say goodbye on
+	if err := serv.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	buf := make([]byte, 65536)
+	list.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, err := list.Read(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+		if len(msg.Answer) == 0 || msg.Answer[0].Header().Name != "_goodbye._tcp.local." {
+			continue
+		}
+		for _, rr := range msg.Answer {
+			if rr.Header().Ttl != 0 {
+				t.Fatalf("bad: %v", rr)
+			}
+		}
+		break
+	}
+}
+
+func TestServer_Ifaces(t *testing.T) {
+	serv := &Server{config: &Config{}}
+	if !serv.allowIface(3) {
+		t.Fatalf("expected all interfaces allowed")
+	}
+
+	serv.config.Ifaces = []net.Interface{{Index: 2}, {Index: 5}}
+	for ifIndex, expect := range map[int]bool{0: false, 2: true, 3: false, 5: true} {
+		if allowed := serv.allowIface(ifIndex); allowed != expect {
+			t.Fatalf("bad: %d %v", ifIndex, allowed)
+		}
+	}
+}
+
+func TestServer_IfacesMulticast(t *testing.T) {
+	old := multicastWrite
+	defer func() { multicastWrite = old }()
+	var sent []int
+	multicastWrite = func(conn *net.UDPConn, buf []byte, addr *net.UDPAddr, ifIndex int) error {
+		if addr != ipv4Addr {
+			t.Fatalf("bad: %v", addr)
+		}
+		sent = append(sent, ifIndex)
+		return nil
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	serv := &Server{
+		config: &Config{
+			Zone:   makeService(t),
+			Ifaces: []net.Interface{{Index: 2}, {Index: 5}},
+		},
+		ipv4List: conn,
+	}
+
+	// Announcements go out of every interface
+	if err := serv.announce(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(sent, []int{2, 5}) {
+		t.Fatalf("bad: %v", sent)
+	}
+}
+
+func TestServer_ResponseDelay(t *testing.T) {
+	s := makeService(t)
+	s.Service = "_delay._tcp"
+	s.Init()
+	serv, err := NewServer(&Config{
+		Zone:             s,
+		DisableIPv6:      true,
+		ResponseDelayMin: 50 * time.Millisecond,
+		ResponseDelayMax: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Ask two questions in quick succession
+	start := time.Now()
+	for _, q := range []dns.Question{
+		{Name: "_delay._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		{Name: s.instanceAddr, Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(q.Name, q.Qtype)
+		buf, err := m.Pack()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := conn.WriteToUDP(buf, ipv4Addr); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Expect a single delayed response answering both
+	var responses []*dns.Msg
+	var first time.Duration
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(start.Add(300 * time.Millisecond))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(responses) == 0 {
+			first = time.Since(start)
+		}
+		responses = append(responses, msg)
+	}
+	if len(responses) != 1 {
+		t.Fatalf("bad: %v", responses)
+	}
+	if first < 50*time.Millisecond || first > 150*time.Millisecond {
+		t.Fatalf("bad delay: %v", first)
+	}
+	var hasPTR, hasTXT bool
+	for _, rr := range responses[0].Answer {
+		switch rr.(type) {
+		case *dns.PTR:
+			hasPTR = true
+		case *dns.TXT:
+			hasTXT = true
+		}
+	}
+	if !hasPTR || !hasTXT {
+		t.Fatalf("bad: %v", responses[0])
+	}
+}
+
+func TestServer_SourceQuestionLimit(t *testing.T) {
+	s := makeService(t)
+	serv := &Server{config: &Config{Zone: s, SourceQuestionLimit: 5}}
+	abusive := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}
+	other := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+
+	query := new(dns.Msg)
+	query.SetQuestion("_http._tcp.local.", dns.TypePTR)
+
+	// Flood from one source, including from other ports
+	answered := 0
+	for i := 0; i < 20; i++ {
+		from := &net.UDPAddr{IP: abusive.IP, Port: 5353 + i}
+		if serv.respond(query, from) != nil {
+			answered++
+		}
+	}
+	if answered != 5 {
+		t.Fatalf("bad: %d", answered)
+	}
+
+	// Another source is still answered
+	if serv.respond(query, other) == nil {
+		t.Fatalf("expected response")
+	}
+}
+
+func TestServer_MultipleQuestions(t *testing.T) {
+	http := makeService(t)
+	ssh := makeService(t)
+	ssh.Service = "_ssh._tcp"
+	ssh.Init()
+	serv := &Server{config: &Config{Zone: multiZone{http, ssh}}}
+
+	query := new(dns.Msg)
+	query.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	query.Question = append(query.Question, dns.Question{
+		Name:   "_ssh._tcp.local.",
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	})
+
+	resp := serv.respond(query, nil)
+	if resp == nil {
+		t.Fatalf("expected response")
+	}
+	if len(resp.Answer) != 2 {
+		t.Fatalf("bad: %v", resp)
+	}
+	for i, name := range []string{"_http._tcp.local.", "_ssh._tcp.local."} {
+		ptr, ok := resp.Answer[i].(*dns.PTR)
+		if !ok || ptr.Hdr.Name != name {
+			t.Fatalf("bad: %v", resp.Answer[i])
+		}
+	}
+}
+
+func TestServer_DisableCompression(t *testing.T) {
+	s := makeService(t)
+	serv := &Server{config: &Config{Zone: s}}
+
+	query := new(dns.Msg)
+	query.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	resp := serv.respond(query, nil)
+	if resp == nil {
+		t.Fatalf("expected response")
+	}
+
+	compressed, err := serv.pack(resp)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv.config.DisableCompression = true
+	uncompressed, err := serv.pack(resp)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(compressed) >= len(uncompressed) {
+		t.Fatalf("bad: %d %d", len(compressed), len(uncompressed))
+	}
+}
+
+func TestServer_MaxResponseSize(t *testing.T) {
+	var zone staticZone
+	for i := 0; i < 50; i++ {
+		zone = append(zone, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   "hostname._http._tcp.local.",
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    120,
+			},
+			Txt: []string{fmt.Sprintf("record=%d,%0100d", i, 0)},
+		})
+	}
+	serv := &Server{config: &Config{Zone: zone, MaxResponseSize: 1000}}
+
+	query := new(dns.Msg)
+	query.SetQuestion("hostname._http._tcp.local.", dns.TypeTXT)
+	resp := serv.respond(query, nil)
+	if resp == nil {
+		t.Fatalf("expected response")
+	}
+	if resp.Truncated {
+		t.Fatalf("truncated before packing")
+	}
+
+	buf, err := serv.pack(resp)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(buf) > 1000 {
+		t.Fatalf("bad: %d", len(buf))
+	}
+	var out dns.Msg
+	if err := out.Unpack(buf); err != nil && err != dns.ErrTruncated {
+		t.Fatalf("err: %v", err)
+	}
+	if !out.Truncated {
+		t.Fatalf("expected TC bit")
+	}
+	if len(out.Answer) == 0 || len(out.Answer) == len(zone) {
+		t.Fatalf("bad: %d", len(out.Answer))
+	}
+}
+
+func TestServer_MatchSourceSubnet(t *testing.T) {
+	old := localAddrs
+	defer func() { localAddrs = old }()
+	listed := 0
+	localAddrs = func(iface *net.Interface) ([]net.Addr, error) {
+		listed++
+		return []net.Addr{
+			&net.IPNet{IP: net.IPv4(10, 0, 0, 5), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.IPv4(192, 168, 1, 5), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+
+	s := makeService(t)
+	serv := &Server{config: &Config{Zone: s, MatchSourceSubnet: true}}
+	query := new(dns.Msg)
+	query.SetQuestion(s.instanceAddr, dns.TypeA)
+
+	cases := []struct {
+		from   net.IP
+		expect net.IP
+	}{
+		{net.IPv4(10, 0, 0, 9), net.IPv4(10, 0, 0, 5)},
+		{net.IPv4(192, 168, 1, 77), net.IPv4(192, 168, 1, 5)},
+
+		// No local address on the subnet, so the zone's address is used
+		{net.IPv4(172, 16, 0, 1), net.IPv4(127, 0, 0, 1)},
+	}
+	for _, c := range cases {
+		resp := serv.respond(query, &net.UDPAddr{IP: c.from, Port: 5353})
+		if resp == nil || len(resp.Answer) != 1 {
+			t.Fatalf("bad: %v", resp)
+		}
+		a, ok := resp.Answer[0].(*dns.A)
+		if !ok || !a.A.Equal(c.expect) {
+			t.Fatalf("bad: %v %v", c.from, resp.Answer[0])
+		}
+	}
+
+	// The local addresses are listed once for all the queries
+	if listed != 1 {
+		t.Fatalf("bad: %d", listed)
+	}
+}
+
+func TestServer_MatchSourceSubnet_HostName(t *testing.T) {
+	old := localAddrs
+	defer func() { localAddrs = old }()
+	localAddrs = func(iface *net.Interface) ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.IPv4(10, 0, 0, 5), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+
+	a := func(name string, ip net.IP) dns.RR {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+			A:   ip,
+		}
+	}
+	zone := staticZone{
+		a("myhost.local.", net.IPv4(172, 16, 0, 1)),
+		a("myhost.local.", net.IPv4(172, 16, 0, 2)),
+		a("other.local.", net.IPv4(172, 16, 0, 3)),
+	}
+	serv := &Server{config: &Config{Zone: zone, MatchSourceSubnet: true, HostName: "myhost.local."}}
+
+	// The host's addresses collapse to the local one, while those of
+	// other hosts in the zone are left alone
+	records := serv.matchSubnet(zone.Records(dns.Question{}), &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9)})
+	if len(records) != 2 {
+		t.Fatalf("bad: %v", records)
+	}
+	if rr := records[0].(*dns.A); rr.Hdr.Name != "myhost.local." || !rr.A.Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Fatalf("bad: %v", rr)
+	}
+	if rr := records[1].(*dns.A); rr.Hdr.Name != "other.local." || !rr.A.Equal(net.IPv4(172, 16, 0, 3)) {
+		t.Fatalf("bad: %v", rr)
+	}
+}
+
+func TestServer_PlaceholderTXT(t *testing.T) {
+	s := makeService(t)
+	s.Info = ""
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   "other._http._tcp.local.",
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    120,
+		},
+	}
+	// The TXT lands in the additional section of a PTR response, and
+	// in the answer when asked for directly
+	cases := []struct {
+		zone  Zone
+		q     dns.Question
+		extra bool
+	}{
+		{s, dns.Question{Name: "_http._tcp.local.", Qtype: dns.TypePTR}, true},
+		{staticZone{txt}, dns.Question{Name: txt.Hdr.Name, Qtype: dns.TypeTXT}, false},
+	}
+	for _, c := range cases {
+		serv := &Server{config: &Config{Zone: c.zone}}
+		query := new(dns.Msg)
+		query.SetQuestion(c.q.Name, c.q.Qtype)
+		resp := serv.respond(query, nil)
+		if resp == nil {
+			t.Fatalf("expected response")
+		}
+
+		// Round trip the response as the client would see it
+		buf, err := serv.pack(resp)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var out dns.Msg
+		if err := out.Unpack(buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		section := out.Answer
+		if c.extra {
+			section = out.Extra
+		}
+		found := false
+		for _, rr := range section {
+			if rr, ok := rr.(*dns.TXT); ok {
+				found = true
+				if len(rr.Txt) != 1 || rr.Txt[0] != "" {
+					t.Fatalf("bad: %v", rr)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("no TXT: %v", out)
+		}
+	}
+
+	// The client completes an entry with an empty TXT
+	query := new(dns.Msg)
+	query.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	resp := (&Server{config: &Config{Zone: s}}).respond(query, nil)
+	entries := make(chan *ServiceEntry, 4)
+	state := newQueryState(&QueryParam{Entries: entries}, discardQuery)
+	state.handleResponse(resp, nil)
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d", len(entries))
+	}
+	if e := <-entries; e.Name != s.instanceAddr || e.Info != "" {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestServer_InstanceQuestions(t *testing.T) {
+	s := makeService(t)
+	serv := &Server{config: &Config{Zone: s}}
+
+	// An instance SRV question is answered with the SRV, and the
+	// addresses of the target as additional records
+	query := new(dns.Msg)
+	query.SetQuestion(s.instanceAddr, dns.TypeSRV)
+	resp := serv.respond(query, nil)
+	if resp == nil || len(resp.Answer) != 1 {
+		t.Fatalf("bad: %v", resp)
+	}
+	srv, ok := resp.Answer[0].(*dns.SRV)
+	if !ok || srv.Hdr.Name != s.instanceAddr || int(srv.Port) != s.Port {
+		t.Fatalf("bad: %v", resp.Answer[0])
+	}
+	if len(resp.Extra) == 0 {
+		t.Fatalf("bad: %v", resp)
+	}
+	for _, rr := range resp.Extra {
+		if _, ok := rr.(*dns.A); !ok {
+			t.Fatalf("bad: %v", rr)
+		}
+	}
+
+	// An instance TXT question is answered with the TXT alone
+	query.SetQuestion(s.instanceAddr, dns.TypeTXT)
+	resp = serv.respond(query, nil)
+	if resp == nil || len(resp.Answer) != 1 || len(resp.Extra) != 0 {
+		t.Fatalf("bad: %v", resp)
+	}
+	if txt, ok := resp.Answer[0].(*dns.TXT); !ok || txt.Txt[0] != s.Info {
+		t.Fatalf("bad: %v", resp.Answer[0])
+	}
+
+	// A browse is answered with the PTR, and the instance records as
+	// additional records
+	query.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	resp = serv.respond(query, nil)
+	if resp == nil || len(resp.Answer) != 1 || len(resp.Extra) != 3 {
+		t.Fatalf("bad: %v", resp)
+	}
+	if _, ok := resp.Answer[0].(*dns.PTR); !ok {
+		t.Fatalf("bad: %v", resp.Answer[0])
+	}
+}
+
+func TestServer_AnswerFromReceivingInterface(t *testing.T) {
+	// Only meaningful on multi-homed hosts
+	var ifaces []net.Interface
+	all, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if ifaceAddr(iface.Index, net.IPv4zero) != nil {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	if len(ifaces) < 2 {
+		t.Skip("needs two multicast interfaces with IPv4 addresses")
+	}
+
+	s := makeService(t)
+	for _, iface := range ifaces {
+		local := ifaceAddr(iface.Index, net.IPv4zero)
+		serv, err := NewServer(&Config{Zone: s, Iface: &iface, DisableIPv6: true})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: local})
+		if err != nil {
+			serv.Shutdown()
+			t.Fatalf("err: %v", err)
+		}
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(&iface); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		q := new(dns.Msg)
+		q.SetQuestion(s.serviceAddr, dns.TypePTR)
+		buf, err := q.Pack()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := conn.WriteToUDP(buf, ipv4Addr); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, from, err := conn.ReadFromUDP(make([]byte, 65536))
+		conn.Close()
+		serv.Shutdown()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !from.IP.Equal(local) {
+			t.Fatalf("bad: %v %v", iface.Name, from)
+		}
+	}
+}
@@ -7,12 +7,22 @@ import (
 	"strings"
 )
 
+// defaultTTL is the default TTL of served records, in seconds
+const defaultTTL = 120
+
 // Zone is the interface used to integrate with the server and
 // to serve records dynamically
 type Zone interface {
 	Records(q dns.Question) []dns.RR
 }
 
+// Announcer is implemented by zones that can list the records to
+// announce unsolicited, such as when the server is configured to
+// periodically re-announce itself
+type Announcer interface {
+	AnnounceRecords() []dns.RR
+}
+
 // MDNSService is used to export a named service by implementing a Zone
 type MDNSService struct {
 	Instance string // Instance name (e.g. host name)
@@ -22,6 +32,18 @@ type MDNSService struct {
 	Info     string // Service info served as a TXT record
 	Domain   string // If blank, assumes ".local"
 
+	// Priority and Weight are served in the SRV record to allow load
+	// balancing across instances. If both are zero, a priority of 10
+	// and a weight of 1 are used, unless ExplicitPriority is set to
+	// serve them as given.
+	Priority         uint16
+	Weight           uint16
+	ExplicitPriority bool
+
+	// TTL is the TTL of the served records in seconds. If zero, a TTL
+	// of 120 seconds is used, as a zero TTL indicates a goodbye.
+	TTL uint32
+
 	serviceAddr  string // Fully qualified service address
 	instanceAddr string // Fully qualified instance address
 }
@@ -47,6 +69,17 @@ func (m *MDNSService) Init() error {
 		return fmt.Errorf("Missing service port")
 	}
 
+	// Setup default TTL
+	if m.TTL == 0 {
+		m.TTL = defaultTTL
+	}
+
+	// Setup default SRV priority and weight
+	if m.Priority == 0 && m.Weight == 0 && !m.ExplicitPriority {
+		m.Priority = 10
+		m.Weight = 1
+	}
+
 	// Create the full addresses
 	m.serviceAddr = fmt.Sprintf("%s.%s.",
 		trimDot(m.Service), trimDot(m.Domain))
@@ -60,6 +93,14 @@ func trimDot(s string) string {
 	return strings.Trim(s, ".")
 }
 
+// AnnounceRecords returns the service PTR along with the instance records
+func (m *MDNSService) AnnounceRecords() []dns.RR {
+	return m.Records(dns.Question{
+		Name:  m.serviceAddr,
+		Qtype: dns.TypePTR,
+	})
+}
+
 func (m *MDNSService) Records(q dns.Question) []dns.RR {
 	switch q.Name {
 	case m.serviceAddr:
@@ -83,7 +124,7 @@ func (m *MDNSService) serviceRecords(q dns.Question) []dns.RR {
 				Name:   q.Name,
 				Rrtype: dns.TypePTR,
 				Class:  dns.ClassINET,
-				Ttl:    0,
+				Ttl:    m.TTL,
 			},
 			Ptr: m.instanceAddr,
 		}
@@ -130,7 +171,7 @@ func (m *MDNSService) instanceRecords(q dns.Question) []dns.RR {
 				Name:   q.Name,
 				Rrtype: dns.TypeA,
 				Class:  dns.ClassINET,
-				Ttl:    0,
+				Ttl:    m.TTL,
 			},
 			A: ipv4,
 		}
@@ -147,7 +188,7 @@ func (m *MDNSService) instanceRecords(q dns.Question) []dns.RR {
 				Name:   q.Name,
 				Rrtype: dns.TypeAAAA,
 				Class:  dns.ClassINET,
-				Ttl:    0,
+				Ttl:    m.TTL,
 			},
 			AAAA: ipv6,
 		}
@@ -160,10 +201,10 @@ func (m *MDNSService) instanceRecords(q dns.Question) []dns.RR {
 				Name:   q.Name,
 				Rrtype: dns.TypeSRV,
 				Class:  dns.ClassINET,
-				Ttl:    0,
+				Ttl:    m.TTL,
 			},
-			Priority: 10,
-			Weight:   1,
+			Priority: m.Priority,
+			Weight:   m.Weight,
 			Port:     uint16(m.Port),
 			Target:   q.Name,
 		}
@@ -188,7 +229,7 @@ func (m *MDNSService) instanceRecords(q dns.Question) []dns.RR {
 				Name:   q.Name,
 				Rrtype: dns.TypeTXT,
 				Class:  dns.ClassINET,
-				Ttl:    0,
+				Ttl:    m.TTL,
 			},
 			Txt: []string{m.Info},
 		}
@@ -181,3 +181,73 @@ func TestMDNSService_InstanceAddr_TXT(t *testing.T) {
 		t.Fatalf("bad: %v", recs[0])
 	}
 }
+
+func TestMDNSService_PriorityWeight(t *testing.T) {
+	s := &MDNSService{
+		Instance: "hostname",
+		Service:  "_http._tcp",
+		Addr:     []byte{127, 0, 0, 1},
+		Port:     80,
+		Priority: 5,
+		Weight:   20,
+	}
+	if err := s.Init(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	q := dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	}
+	recs := s.Records(q)
+	srv, ok := recs[1].(*dns.SRV)
+	if !ok {
+		t.Fatalf("bad: %v", recs[1])
+	}
+	if srv.Priority != 5 || srv.Weight != 20 {
+		t.Fatalf("bad: %v", srv)
+	}
+
+	// Ensure the client surfaces them
+	e := FromRecords(recs)
+	if e.Priority != 5 || e.Weight != 20 {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// A zero priority and weight are only served if asked for
+	for _, explicit := range []bool{false, true} {
+		s := &MDNSService{
+			Instance:         "hostname",
+			Service:          "_http._tcp",
+			Addr:             []byte{127, 0, 0, 1},
+			Port:             80,
+			ExplicitPriority: explicit,
+		}
+		if err := s.Init(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		srv := s.Records(q)[1].(*dns.SRV)
+		if zero := srv.Priority == 0 && srv.Weight == 0; zero != explicit {
+			t.Fatalf("bad: %v %v", explicit, srv)
+		}
+	}
+}
+
+func TestMDNSService_TTL(t *testing.T) {
+	s := makeService(t)
+	q := dns.Question{
+		Name:  "_http._tcp.local.",
+		Qtype: dns.TypePTR,
+	}
+	for _, rr := range s.Records(q) {
+		if rr.Header().Ttl != defaultTTL {
+			t.Fatalf("bad: %v", rr)
+		}
+	}
+
+	s.TTL = 10
+	for _, rr := range s.Records(q) {
+		if rr.Header().Ttl != 10 {
+			t.Fatalf("bad: %v", rr)
+		}
+	}
+}